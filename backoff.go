@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultReconnectMinDelay = 1 * time.Second
+	defaultReconnectMaxDelay = 5 * time.Minute
+)
+
+// backoff hands out jittered, exponentially growing delays between min and max
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt uint
+}
+
+func newReconnectBackoff() *backoff {
+	b := &backoff{min: defaultReconnectMinDelay, max: defaultReconnectMaxDelay}
+	if config.ReconnectMaxDelay > 0 {
+		b.max = time.Duration(config.ReconnectMaxDelay) * time.Second
+	}
+	if b.min > b.max {
+		b.min = b.max
+	}
+	return b
+}
+
+// next ...
+// Returns the delay to wait before the upcoming attempt. The delay doubles
+// every attempt until it hits max, and is then jittered down by up to half
+// so a fleet of bots doesn't reconnect in lockstep.
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.attempt < 32 {
+		if d := b.min << b.attempt; d > 0 && d < b.max {
+			delay = d
+		}
+	}
+	b.attempt++
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// reset ...
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// How long a connection must stay up before its backoff is reset
+const connectionHealthyAfter = 30 * time.Second
+
+// connectionBackoff paces reconnects across the connections of one team. It's
+// only reset once a connection has stayed up for a while, so a connection
+// slack accepts and then drops straight away is retried no faster than one
+// which fails outright.
+type connectionBackoff struct {
+	*backoff
+	started bool
+	// when slack last said hello; zero if it hasn't since we last connected
+	establishedAt time.Time
+}
+
+func newConnectionBackoff() *connectionBackoff {
+	return &connectionBackoff{backoff: newReconnectBackoff()}
+}
+
+// established ...
+// Called when slack says hello on a new connection
+func (b *connectionBackoff) established() {
+	b.establishedAt = time.Now()
+}
+
+// beforeConnect ...
+// How long to wait before connecting: nothing the first time, or after a
+// connection which stayed healthy; otherwise the next backoff delay
+func (b *connectionBackoff) beforeConnect() time.Duration {
+	healthy := !b.establishedAt.IsZero() && time.Since(b.establishedAt) >= connectionHealthyAfter
+	b.establishedAt = time.Time{}
+	if !b.started {
+		b.started = true
+		return 0
+	}
+	if healthy {
+		b.reset()
+		return 0
+	}
+	return b.next()
+}
+
+// errStopping is what retries return when the team is shut down before they succeed
+var errStopping = errors.New("shutting down")
+
+// sleepUnlessStopped ...
+// Sleeps for delay, returning errStopping straight away should stop close first
+func sleepUnlessStopped(delay time.Duration, stop <-chan struct{}) error {
+	select {
+	case <-stop:
+		return errStopping
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// connectWithRetry ...
+// Keeps calling dial until it succeeds, sleeping a jittered backoff (b's,
+// which carries on from earlier connections) between failures. Gives up once
+// config.ReconnectGiveUpAttempts consecutive attempts have failed; zero means
+// retry forever. Stops early, with errStopping, once stop is closed.
+func connectWithRetry(what string, b *backoff, stop <-chan struct{}, dial func() (websocketData, error)) (websocketData, error) {
+	var wsClient websocketData
+	err := retryWithBackoff(what, b, stop, func() error {
+		var err error
+		wsClient, err = dial()
+		return err
+	})
+	return wsClient, err
+}
+
+// retryWithBackoff ...
+// connectWithRetry for anything else which needs slack to be reachable; a
+// nil b starts a new backoff
+func retryWithBackoff(what string, b *backoff, stop <-chan struct{}, attemptFn func() error) error {
+	if b == nil {
+		b = newReconnectBackoff()
+	}
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-stop:
+			return errStopping
+		default:
+		}
+		log.Printf("Connecting to %s (attempt %d)...", what, attempt)
+		err := attemptFn()
+		if err == nil {
+			return nil
+		}
+		if config.ReconnectGiveUpAttempts > 0 && attempt >= config.ReconnectGiveUpAttempts {
+			return fmt.Errorf("gave up connecting to %s after %d attempts: %s", what, attempt, err)
+		}
+		delay := b.next()
+		log.Printf("Failed connecting to %s: %s; retrying in %s", what, err, delay)
+		if err := sleepUnlessStopped(delay, stop); err != nil {
+			return err
+		}
+	}
+}
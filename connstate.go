@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type connState int
+
+const (
+	connStateDisconnected connState = iota
+	// websocket is up, but slack hasn't said hello yet
+	connStateConnecting
+	connStateConnected
+	// slack told us to go away (goodbye, disconnect, a dead socket, ...)
+	connStateReconnecting
+	// our team is moving between slack hosts; expect reconnects to fail for a bit
+	connStateMigrating
+	// we ran out of reconnect attempts (config.ReconnectGiveUpAttempts)
+	connStateGaveUp
+)
+
+func (s connState) String() string {
+	switch s {
+	case connStateConnecting:
+		return "connecting"
+	case connStateConnected:
+		return "connected"
+	case connStateReconnecting:
+		return "reconnecting"
+	case connStateMigrating:
+		return "migrating"
+	case connStateGaveUp:
+		return "gave up"
+	}
+	return "disconnected"
+}
+
+// connStatus is what the rest of the bot can learn about the slack connection
+type connStatus struct {
+	// the team, for logging
+	team  string
+	mu    sync.RWMutex
+	state connState
+	since time.Time
+	// the last error slack sent us, or that we gave up on, if any
+	lastError   error
+	lastErrorAt time.Time
+}
+
+// set ...
+func (c *connStatus) set(state connState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != state {
+		logDebug(fmt.Sprintf("Slack connection for team [%s] is now %s", c.team, state))
+		c.state = state
+		c.since = time.Now()
+	}
+}
+
+// get ...
+// Returns the current state and when we entered it
+func (c *connStatus) get() (connState, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.state, c.since
+}
+
+// connected ...
+func (c *connStatus) connected() bool {
+	state, _ := c.get()
+	return state == connStateConnected
+}
+
+// setError ...
+func (c *connStatus) setError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastError = err
+	c.lastErrorAt = time.Now()
+}
+
+// getError ...
+// Returns the last error we had (nil if none) and when we had it
+func (c *connStatus) getError() (error, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastError, c.lastErrorAt
+}
@@ -1,14 +1,28 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 )
 
-func getDilbertPostedDir() string {
+var (
+	// Where each day's strip lives; formatted with the date
+	dilbertStripUrl = "http://dilbert.com/strip/%s"
+	// The hour from which we start looking for the day's strip
+	dilbertFirstHour = 7
+)
+
+// getDilbertPostedDir ...
+// Named teams keep their records in a subdirectory of their own
+func getDilbertPostedDir(team *slackTeam) string {
 	dilbertDir := fmt.Sprintf("%s/dilbertPosted", getHomeEtc())
+	if len(team.config.Name) > 0 {
+		dilbertDir = fmt.Sprintf("%s/%s", dilbertDir, team.config.Name)
+	}
 
 	err := createDirIfMissing(dilbertDir, 0750)
 	if err != nil {
@@ -18,42 +32,47 @@ func getDilbertPostedDir() string {
 	return dilbertDir
 }
 
-func getTodaysDilbertFile() string {
+func getTodaysDilbertFile(team *slackTeam) string {
 	timeNow := time.Now()
 	year, month, day := timeNow.Date()
 	curDate := fmt.Sprintf("%d-%s-%d", year, month, day)
 
-	return fmt.Sprintf("%s/%s", getDilbertPostedDir(), curDate)
+	return fmt.Sprintf("%s/%s", getDilbertPostedDir(team), curDate)
 }
 
-func signifyDilbertPostedToday() {
-	dilbertSignifyFile := getTodaysDilbertFile()
+func signifyDilbertPostedToday(team *slackTeam) {
+	dilbertSignifyFile := getTodaysDilbertFile(team)
 	err := createFile(dilbertSignifyFile)
 	if err != nil {
-		log.Fatalf(fmt.Sprintf("##Error creating [%s]: %s", dilbertSignifyFile, err))
+		log.Fatalf("##Error creating [%s]: %s", dilbertSignifyFile, err)
 	}
 }
 
-func dilbertRoutine(wsClient websocketData) {
-	// if we arent connected atm give up now
-	if !wsClient.ws.IsClientConn() {
-		logDebug("dilbertRoutine() wsClient.ws.IsClientConn says we arent connected! Bailing..")
+// dilbertHandler ...
+// There's no dilbert event; every event is just a chance to check for today's comic
+func dilbertHandler(ctx context.Context, team *slackTeam, slackEvent slackRtmEvent) {
+	dilbertRoutine(ctx, team)
+}
+
+func dilbertRoutine(ctx context.Context, team *slackTeam) {
+	// every event is a chance, so someone else is usually already looking
+	if !team.store.TryLock() {
 		return
 	}
-
+	defer team.store.Unlock()
 	timeNow := time.Now()
 
 	// bail now if we've already posted today
-	todaysDilbert := getTodaysDilbertFile()
+	todaysDilbert := getTodaysDilbertFile(team)
 	if pathExists(todaysDilbert) {
 		return
 	}
 
 	// only start looking for new comics at 7am
-	if timeNow.Hour() >= 7 {
+	if timeNow.Hour() >= dilbertFirstHour {
 		// back off now if instructed
-		if !store.DilbertBackOffUntil.IsZero() {
-			if !timeNow.After(store.DilbertBackOffUntil) {
+		if !team.store.DilbertBackOffUntil.IsZero() {
+			if !timeNow.After(team.store.DilbertBackOffUntil) {
 				return
 			}
 		}
@@ -63,25 +82,56 @@ func dilbertRoutine(wsClient websocketData) {
 		dateString := fmt.Sprintf("%d-%s-%d", year, month, day)
 
 		// define assumed url for todays comic
-		comic := fmt.Sprintf("http://dilbert.com/strip/%s", dateString)
+		comic := fmt.Sprintf(dilbertStripUrl, dateString)
 
 		// verify comic exists or bail
 		httpClient := &http.Client{Timeout: time.Duration(time.Duration(3) * time.Second)}
-		resp, err := httpClient.Get(comic)
+		req, err := http.NewRequestWithContext(ctx, "GET", comic, nil)
+		if err != nil {
+			log.Printf("Error building dilbert.com request: %s", err)
+			return
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			logDebug(fmt.Sprintf("Error requesting dilbert.com: [%s]", err))
+			team.store.DilbertBackOffUntil = timeNow.Add(time.Duration(600) * time.Second)
+			return
+		}
 		defer resp.Body.Close()
-		if resp.StatusCode != 200 || err != nil {
-			// dilbert isnt yet present (or some error); oh noes!
+		if resp.StatusCode != 200 {
+			// dilbert isnt yet present; oh noes!
 			// Tell future dilbert routines to not try another HTTP request
 			// for another 10 minutes
-			logDebug(fmt.Sprintf("Error response from dilbert.com: code [%s] err [%s]", resp.StatusCode, err))
-			store.DilbertBackOffUntil = timeNow.Add(time.Duration(600) * time.Second)
+			logDebug(fmt.Sprintf("Error response from dilbert.com: code [%d]", resp.StatusCode))
+			team.store.DilbertBackOffUntil = timeNow.Add(time.Duration(600) * time.Second)
+			return
+		}
+		dilbertChannel, err := team.directory.resolveChannel(team.config.SlackDilbertChannel)
+		if err != nil {
+			log.Printf("Can't post dilbert: %s", err)
+			team.store.DilbertBackOffUntil = timeNow.Add(time.Duration(600) * time.Second)
 			return
 		}
-		wsClient.createSlackPost(fmt.Sprintf("%s\n", comic), config.SlackDilbertChannel)
-		logDebug(fmt.Sprintf("Dilbert posted: %s", comic))
+		if handlerCancelled(ctx, team, "dilbert") {
+			return
+		}
+		delivered := team.poster.createSlackPost(fmt.Sprintf("%s\n", comic), dilbertChannel)
 		// update records that we posted today
-		signifyDilbertPostedToday()
+		signifyDilbertPostedToday(team)
+		// delivery is confirmed by the read loop, so don't block it waiting;
+		// shutdown still does, so a failed post is forgotten
+		team.work.Add(1)
+		go func(todaysDilbert string) {
+			defer team.work.Done()
+			if result := <-delivered; result.Err != nil {
+				// forget we posted, so the next event tries again
+				log.Printf("Failed posting dilbert [%s]: %s", comic, result.Err)
+				os.Remove(todaysDilbert)
+				return
+			}
+			logDebug(fmt.Sprintf("Dilbert posted: %s", comic))
+		}(todaysDilbert)
 		// reset back to zero time
-		store.DilbertBackOffUntil = time.Time{}
+		team.store.DilbertBackOffUntil = time.Time{}
 	}
 }
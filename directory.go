@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type slackUser struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Deleted bool   `json:"deleted,omitempty"`
+	IsBot   bool   `json:"is_bot,omitempty"`
+	Profile struct {
+		RealName    string `json:"real_name,omitempty"`
+		DisplayName string `json:"display_name,omitempty"`
+	} `json:"profile"`
+}
+
+type slackChannel struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	IsArchived bool   `json:"is_archived,omitempty"`
+}
+
+// slackDirectory knows the users and channels of one team, by ID and by name
+type slackDirectory struct {
+	mu         sync.RWMutex
+	users      map[string]slackUser
+	userIds    map[string]string
+	channels   map[string]slackChannel
+	channelIds map[string]string
+}
+
+func newSlackDirectory() *slackDirectory {
+	return &slackDirectory{
+		users:      map[string]slackUser{},
+		userIds:    map[string]string{},
+		channels:   map[string]slackChannel{},
+		channelIds: map[string]string{},
+	}
+}
+
+// load ...
+// Replaces everything we know with users and channels, all at once, so
+// lookups meanwhile see either the old directory or the new one
+func (d *slackDirectory) load(users []slackUser, channels []slackChannel) {
+	loaded := newSlackDirectory()
+	for _, user := range users {
+		loaded.setUser(user)
+	}
+	for _, channel := range channels {
+		loaded.setChannel(channel)
+	}
+	d.mu.Lock()
+	d.users, d.userIds = loaded.users, loaded.userIds
+	d.channels, d.channelIds = loaded.channels, loaded.channelIds
+	d.mu.Unlock()
+	logDebug(fmt.Sprintf("Directory loaded with %d users and %d channels", len(users), len(channels)))
+}
+
+// setUser ...
+func (d *slackDirectory) setUser(user slackUser) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.users[user.Id]; ok && d.userIds[old.Name] == user.Id {
+		delete(d.userIds, old.Name)
+	}
+	d.users[user.Id] = user
+	if !user.Deleted {
+		d.userIds[user.Name] = user.Id
+	}
+}
+
+// setChannel ...
+func (d *slackDirectory) setChannel(channel slackChannel) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.channels[channel.Id]; ok && d.channelIds[old.Name] == channel.Id {
+		delete(d.channelIds, old.Name)
+	}
+	d.channels[channel.Id] = channel
+	d.channelIds[channel.Name] = channel.Id
+}
+
+// removeChannel ...
+func (d *slackDirectory) removeChannel(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.channels[id]; ok && d.channelIds[old.Name] == id {
+		delete(d.channelIds, old.Name)
+	}
+	delete(d.channels, id)
+}
+
+// user ...
+func (d *slackDirectory) user(id string) (slackUser, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	user, ok := d.users[id]
+	return user, ok
+}
+
+// fullName ...
+// The most human name slack has for user
+func (user slackUser) fullName() string {
+	if len(user.Profile.RealName) > 0 {
+		return user.Profile.RealName
+	}
+	if len(user.Profile.DisplayName) > 0 {
+		return user.Profile.DisplayName
+	}
+	return user.Name
+}
+
+// channel ...
+func (d *slackDirectory) channel(id string) (slackChannel, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	channel, ok := d.channels[id]
+	return channel, ok
+}
+
+// resolveChannel ...
+// Turns "#general" into its channel ID; anything else is assumed to be an ID
+// already and comes back untouched
+func (d *slackDirectory) resolveChannel(name string) (string, error) {
+	if !strings.HasPrefix(name, "#") {
+		return name, nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if id, ok := d.channelIds[strings.TrimPrefix(name, "#")]; ok {
+		return id, nil
+	}
+	return "", fmt.Errorf("no channel named [%s]", name)
+}
+
+// resolveUser ...
+// Turns "@alice" into that user's ID; anything else comes back untouched
+func (d *slackDirectory) resolveUser(name string) (string, error) {
+	if !strings.HasPrefix(name, "@") {
+		return name, nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if id, ok := d.userIds[strings.TrimPrefix(name, "@")]; ok {
+		return id, nil
+	}
+	return "", fmt.Errorf("no user named [%s]", name)
+}
+
+// mention ...
+// Slack markup mentioning a user, given "@alice" or an ID; false if the
+// directory has no one by that name
+func (d *slackDirectory) mention(name string) (string, bool) {
+	id, err := d.resolveUser(name)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("<@%s>", id), true
+}
+
+// loadDirectory ...
+// Fills the team's directory from the Web API
+func (team *slackTeam) loadDirectory() error {
+	users, err := team.web.listUsers()
+	if err != nil {
+		return err
+	}
+	channels, err := team.web.listConversations()
+	if err != nil {
+		return err
+	}
+	team.directory.load(users, channels)
+	return nil
+}
+
+// processDirectoryEvent ...
+// Keeps the directory current as users and channels come, go and get renamed
+// {"type":"channel_rename","channel":{"id":"C123","name":"new-name","created":1360782804}}
+func processDirectoryEvent(ctx context.Context, team *slackTeam, slackEvent slackRtmEvent) {
+	switch slackEvent.Type {
+	case "user_change", "team_join":
+		if slackEvent.UserInfo != nil {
+			team.directory.setUser(*slackEvent.UserInfo)
+		}
+	case "channel_created", "channel_rename", "group_rename":
+		if slackEvent.ChannelInfo != nil {
+			team.directory.setChannel(*slackEvent.ChannelInfo)
+		}
+	case "channel_deleted", "channel_archive", "group_archive":
+		// these carry just the channel ID
+		if len(slackEvent.Channel) > 0 {
+			team.directory.removeChannel(slackEvent.Channel)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// How many source messages we remember our replies to
+const maxTrackedReplies = 1000
+
+// How long an edit or deletion waits for the replies it affects to be delivered
+const replyDeliveryWait = 30 * time.Second
+
+// trackedReply is one message we posted in answer to another
+type trackedReply struct {
+	channel string
+	ts      string
+}
+
+// trackedReplies are our replies to one source message. They're tracked as
+// soon as they're queued; ready is closed once they've all been delivered
+// (or failed to be), and only then is replies filled in.
+type trackedReplies struct {
+	ready   chan struct{}
+	replies []trackedReply
+}
+
+// replyTracker remembers which of our messages answered which source message,
+// so edits and deletions of the source can be reflected in our replies
+type replyTracker struct {
+	mu      sync.Mutex
+	replies map[string]*trackedReplies
+	// keys of replies, oldest first
+	order []string
+}
+
+func newReplyTracker() *replyTracker {
+	return &replyTracker{replies: map[string]*trackedReplies{}}
+}
+
+func replyTrackerKey(channel string, sourceTs string) string {
+	return fmt.Sprintf("%s/%s", channel, sourceTs)
+}
+
+// track ...
+// Records the replies to a source message right away: those already posted,
+// and those still on their way, which are added once delivered
+func (t *replyTracker) track(channel string, sourceTs string, posted []trackedReply, delivered []<-chan slackPostResult) {
+	tracked := &trackedReplies{ready: make(chan struct{})}
+	key := replyTrackerKey(channel, sourceTs)
+	t.mu.Lock()
+	if _, ok := t.replies[key]; !ok {
+		t.order = append(t.order, key)
+		for len(t.order) > maxTrackedReplies {
+			delete(t.replies, t.order[0])
+			t.order = t.order[1:]
+		}
+	}
+	t.replies[key] = tracked
+	t.mu.Unlock()
+	go func() {
+		replies := append(posted, awaitReplies(delivered)...)
+		t.mu.Lock()
+		tracked.replies = replies
+		t.mu.Unlock()
+		close(tracked.ready)
+	}()
+}
+
+// awaitReplies ...
+func awaitReplies(delivered []<-chan slackPostResult) []trackedReply {
+	var replies []trackedReply
+	for _, d := range delivered {
+		if result := <-d; result.Err == nil && len(result.Ts) > 0 {
+			replies = append(replies, trackedReply{result.Channel, result.Ts})
+		}
+	}
+	return replies
+}
+
+// forget ...
+func (t *replyTracker) forget(channel string, sourceTs string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.replies, replyTrackerKey(channel, sourceTs))
+}
+
+// get ...
+// Our replies to a source message, waiting for any still being delivered
+func (t *replyTracker) get(channel string, sourceTs string) []trackedReply {
+	t.mu.Lock()
+	tracked, ok := t.replies[replyTrackerKey(channel, sourceTs)]
+	t.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case <-tracked.ready:
+	case <-time.After(replyDeliveryWait):
+		log.Printf("Replies to [%s] in [%s] still undelivered after %s", sourceTs, channel, replyDeliveryWait)
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return tracked.replies
+}
+
+// processJiraEdit ...
+// Handles message_changed and message_deleted, bringing the replies we
+// posted for the original message in line with what it says now
+func processJiraEdit(ctx context.Context, team *slackTeam, slackEvent slackRtmEvent) {
+	switch slackEvent.Subtype {
+	case "message_deleted":
+		replies := team.replies.get(slackEvent.Channel, slackEvent.DeletedTs)
+		if handlerCancelled(ctx, team, "deletions") {
+			return
+		}
+		for _, reply := range replies {
+			team.poster.deleteSlackMessage(reply.channel, reply.ts)
+		}
+		team.replies.forget(slackEvent.Channel, slackEvent.DeletedTs)
+	case "message_changed":
+		if slackEvent.Message == nil {
+			log.Printf("Invalid message_changed received from slack? [%s]", slackEvent.Raw)
+			return
+		}
+		edited := *slackEvent.Message
+		if slackEvent.PreviousMessage != nil && edited.Text == slackEvent.PreviousMessage.Text {
+			// slack also sends message_changed when it unfurls links
+			return
+		}
+		edited.Channel = slackEvent.Channel
+		reconcileJiraReplies(ctx, team, edited, jiraReplies(ctx, team, edited))
+	}
+}
+
+// reconcileJiraReplies ...
+// Edits our existing replies to edited in place, posting or deleting the
+// difference when it now mentions more or fewer issues
+func reconcileJiraReplies(ctx context.Context, team *slackTeam, edited slackRtmEvent, replies []slackMessage) {
+	existing := team.replies.get(edited.Channel, edited.Ts)
+	if len(existing) == 0 && len(replies) == 0 {
+		return
+	}
+	if handlerCancelled(ctx, team, "edited jira replies") {
+		return
+	}
+	var kept []trackedReply
+	var delivered []<-chan slackPostResult
+	for i, reply := range replies {
+		if i < len(existing) {
+			reply.Channel, reply.Ts = existing[i].channel, existing[i].ts
+			team.poster.updateSlackMessage(reply)
+			kept = append(kept, existing[i])
+		} else {
+			delivered = append(delivered, team.poster.createRichSlackPost(team.replyTo(edited, reply)))
+		}
+	}
+	for i := len(replies); i < len(existing); i++ {
+		team.poster.deleteSlackMessage(existing[i].channel, existing[i].ts)
+	}
+	if len(replies) == 0 {
+		team.replies.forget(edited.Channel, edited.Ts)
+		return
+	}
+	team.replies.track(edited.Channel, edited.Ts, kept, delivered)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDecodeMessageEvent(t *testing.T) {
+	raw := `{"type":"message","channel":"C1","user":"U1","text":"hello","ts":"1.2","thread_ts":"1.1",` +
+		`"edited":{"user":"U1","ts":"1.3"},"files":[{"id":"F1","name":"a.txt","mimetype":"text/plain"}]}`
+	var slackEvent slackRtmEvent
+	if err := json.Unmarshal([]byte(raw), &slackEvent); err != nil {
+		t.Fatal(err)
+	}
+	if slackEvent.Type != "message" || slackEvent.Channel != "C1" || slackEvent.User != "U1" || slackEvent.ThreadTs != "1.1" {
+		t.Errorf("Unexpected event %+v", slackEvent)
+	}
+	if slackEvent.Edited == nil || slackEvent.Edited.Ts != "1.3" {
+		t.Errorf("Expected edited at 1.3, got %+v", slackEvent.Edited)
+	}
+	if len(slackEvent.Files) != 1 || slackEvent.Files[0].Name != "a.txt" {
+		t.Errorf("Expected one file a.txt, got %+v", slackEvent.Files)
+	}
+	if string(slackEvent.Raw) != raw {
+		t.Errorf("Expected the raw event to be kept, got [%s]", slackEvent.Raw)
+	}
+}
+
+func TestDecodeObjectsInPlaceOfIds(t *testing.T) {
+	var renamed slackRtmEvent
+	if err := json.Unmarshal([]byte(`{"type":"channel_rename","channel":{"id":"C1","name":"ops"}}`), &renamed); err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Channel != "C1" || renamed.ChannelInfo == nil || renamed.ChannelInfo.Name != "ops" {
+		t.Errorf("Expected channel C1 named ops, got %+v", renamed)
+	}
+	var joined slackRtmEvent
+	if err := json.Unmarshal([]byte(`{"type":"team_join","user":{"id":"U9","name":"bob"}}`), &joined); err != nil {
+		t.Fatal(err)
+	}
+	if joined.User != "U9" || joined.UserInfo == nil || joined.UserInfo.Name != "bob" {
+		t.Errorf("Expected user U9 named bob, got %+v", joined)
+	}
+}
+
+func TestDecodeMessageChanged(t *testing.T) {
+	raw := `{"type":"message","subtype":"message_changed","channel":"C1",` +
+		`"message":{"type":"message","user":"U1","text":"after","ts":"1.1","edited":{"user":"U1","ts":"1.5"}},` +
+		`"previous_message":{"type":"message","user":"U1","text":"before","ts":"1.1"}}`
+	var slackEvent slackRtmEvent
+	if err := json.Unmarshal([]byte(raw), &slackEvent); err != nil {
+		t.Fatal(err)
+	}
+	if slackEvent.Message == nil || slackEvent.Message.Text != "after" || slackEvent.Message.Edited == nil {
+		t.Errorf("Unexpected message %+v", slackEvent.Message)
+	}
+	if slackEvent.PreviousMessage == nil || slackEvent.PreviousMessage.Text != "before" {
+		t.Errorf("Unexpected previous message %+v", slackEvent.PreviousMessage)
+	}
+}
+
+func TestDecodeToleratesUnexpectedTypes(t *testing.T) {
+	var slackEvent slackRtmEvent
+	if err := json.Unmarshal([]byte(`{"type":"message","channel":"C1","bot_id":7,"text":"still here"}`), &slackEvent); err != nil {
+		t.Fatal(err)
+	}
+	if slackEvent.Text != "still here" || slackEvent.Channel != "C1" {
+		t.Errorf("Expected the rest of the event to survive, got %+v", slackEvent)
+	}
+	if err := json.Unmarshal([]byte(`{"type":`), &slackEvent); err == nil {
+		t.Error("Expected truncated json to be rejected")
+	}
+}
+
+func TestIgnoreMessage(t *testing.T) {
+	team := newSlackTeam(teamConfig{AllowedBots: []string{"BFRIEND", "@deploybot", "@nobody"}})
+	team.self.set("UBOT", "BBOT", "T1")
+	team.directory.load([]slackUser{{Id: "UDEPLOY", Name: "deploybot", IsBot: true}, {Id: "UOTHER", Name: "otherbot", IsBot: true}}, nil)
+	for _, tc := range []struct {
+		slackEvent slackRtmEvent
+		ignored    bool
+	}{
+		{slackRtmEvent{Type: "message", User: "U1"}, false},
+		{slackRtmEvent{Type: "message", User: "UBOT"}, true},
+		{slackRtmEvent{Type: "message", Subtype: "bot_message", BotId: "BOTHER"}, true},
+		{slackRtmEvent{Type: "message", Subtype: "bot_message", BotId: "BFRIEND"}, false},
+		{slackRtmEvent{Type: "message", User: "UDEPLOY", BotId: "BDEPLOY"}, false},
+		{slackRtmEvent{Type: "message", User: "UOTHER", BotId: "BOTHER"}, true},
+		{slackRtmEvent{Type: "message", Subtype: "message_changed", Message: &slackRtmEvent{BotId: "BBOT"}}, true},
+		{slackRtmEvent{Type: "user_typing", User: "UBOT"}, false},
+	} {
+		if ignored := team.ignoreMessage(tc.slackEvent); ignored != tc.ignored {
+			t.Errorf("Expected ignoreMessage(%+v) to be %t", tc.slackEvent, tc.ignored)
+		}
+	}
+}
+
+func TestJiraRequestsFromEvents(t *testing.T) {
+	slackEvent := slackRtmEvent{Type: "message", Text: "what about jira#ABC-1.describe and jira#DEF-22?"}
+	if !isJiraIssueUrlRequest(slackEvent) || !jiraIssueDescriptionRequested(slackEvent) {
+		t.Error("Expected a jira description request")
+	}
+	issues, err := getJiraIssues(slackEvent)
+	if err != nil || len(issues) != 2 || issues[0] != "ABC-1" || issues[1] != "DEF-22" {
+		t.Errorf("Unexpected issues %v (%v)", issues, err)
+	}
+	if isJiraIssueUrlRequest(slackRtmEvent{Type: "message", Text: "no issues here"}) {
+		t.Error("Expected no jira request")
+	}
+}
+
+func TestJiraIssueKeysRejectPunctuation(t *testing.T) {
+	issues, err := getJiraIssues(slackRtmEvent{Type: "message", Text: "jira#[-1 jira#_A-2 jira#OPS_2-3"})
+	if err != nil || len(issues) != 1 || issues[0] != "OPS_2-3" {
+		t.Errorf("Expected only OPS_2-3, got %v (%v)", issues, err)
+	}
+	if _, err := getJiraIssues(slackRtmEvent{Type: "message", Text: "jira#nope"}); err == nil {
+		t.Error("Expected an error for jira# without a key")
+	}
+}
+
+func TestBareJiraIssues(t *testing.T) {
+	projects := []string{"OPS", "DEV"}
+	for _, tc := range []struct {
+		text string
+		want []string
+	}{
+		{"OPS-1423 is on fire", []string{"OPS-1423"}},
+		{"see OPS-1, DEV-22 and NOPE-3", []string{"OPS-1", "DEV-22"}},
+		{"UTF-8 and SHA-256 aren't issues", nil},
+		{"not XOPS-1 or OPS-1a or ops-1", nil},
+		{"`OPS-1` in code, ```\nDEV-2\n``` too", nil},
+		{"<https://jira.example.com/browse/OPS-7|OPS-7> and https://example.com/OPS-8", nil},
+		{"jira#OPS-9 is explicit already", nil},
+	} {
+		got := getBareJiraIssues(tc.text, projects)
+		if len(got) != len(tc.want) {
+			t.Errorf("getBareJiraIssues(%q) = %v, want %v", tc.text, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("getBareJiraIssues(%q) = %v, want %v", tc.text, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestBareJiraKeysArePerChannel(t *testing.T) {
+	team := newSlackTeam(teamConfig{
+		JiraProjects: []string{"OPS"},
+		Channels:     map[string]channelConfig{"C1": {BareJiraKeys: true}},
+	})
+	issues, _ := team.jiraIssuesMentioned(slackRtmEvent{Type: "message", Channel: "C1", Text: "OPS-1 and jira#OPS-1 and jira#ops-2"})
+	if len(issues) != 2 || issues[0] != "OPS-1" || issues[1] != "ops-2" {
+		t.Errorf("Expected OPS-1 and ops-2 once each, got %v", issues)
+	}
+	if issues, _ := team.jiraIssuesMentioned(slackRtmEvent{Type: "message", Channel: "C2", Text: "OPS-1"}); len(issues) != 0 {
+		t.Errorf("Expected bare keys to be ignored in C2, got %v", issues)
+	}
+}
+
+func TestJiraIssueUnfurl(t *testing.T) {
+	var issue jiraIssueResp
+	if err := json.Unmarshal([]byte(`{"key":"OPS-1","fields":{"summary":"Disk full","status":{"name":"Done",`+
+		`"statusCategory":{"key":"done","name":"Done"}},"issuetype":{"name":"Task"},"priority":{"name":"High"},`+
+		`"reporter":{"name":"bob"},"assignee":null,"labels":["disk","prod"],"fixVersions":[{"name":"1.2"},{"name":"1.3"}],`+
+		`"created":"2017-06-20T11:05:09.000+0000","updated":"nonsense"}}`), &issue); err != nil {
+		t.Fatal(err)
+	}
+	people := newSlackDirectory()
+	people.load([]slackUser{{Id: "U2", Name: "bob"}}, nil)
+	msg := jiraIssueUnfurl("https://jira.example.com", issue, people)
+	if len(msg.Attachments) != 1 {
+		t.Fatalf("Expected one attachment, got %+v", msg)
+	}
+	card := msg.Attachments[0]
+	if card.Title != "OPS-1: Disk full" || card.TitleLink != "https://jira.example.com/browse/OPS-1" || card.Color != jiraStatusColors["done"] {
+		t.Errorf("Unexpected card %+v", card)
+	}
+	if card.Fallback != "[OPS-1] Disk full (Done)" || card.Footer != "Created 2017-06-20" {
+		t.Errorf("Unexpected fallback [%s] or footer [%s]", card.Fallback, card.Footer)
+	}
+	want := map[string]string{"Status": "Done", "Type": "Task", "Priority": "High", "Assignee": "Unassigned",
+		"Reporter": "<@U2>", "Labels": "disk, prod", "Fix versions": "1.2, 1.3"}
+	if len(card.Fields) != len(want) {
+		t.Errorf("Expected %d fields, got %+v", len(want), card.Fields)
+	}
+	for _, field := range card.Fields {
+		if want[field.Title] != field.Value || !field.Short {
+			t.Errorf("Unexpected field %+v", field)
+		}
+	}
+}
+
+func TestConnectionBackoffResetsOnlyWhenHealthy(t *testing.T) {
+	b := newConnectionBackoff()
+	if delay := b.beforeConnect(); delay != 0 {
+		t.Errorf("Expected to connect straight away the first time, waited %s", delay)
+	}
+	b.established()
+	if delay := b.beforeConnect(); delay == 0 {
+		t.Error("Expected to wait after a connection which dropped straight away")
+	}
+	first := b.attempt
+	b.beforeConnect()
+	if b.attempt <= first {
+		t.Error("Expected the backoff to keep growing while connections fail")
+	}
+	b.establishedAt = time.Now().Add(-connectionHealthyAfter)
+	if delay := b.beforeConnect(); delay != 0 || b.attempt != 0 {
+		t.Errorf("Expected a healthy connection to reset the backoff, waited %s at attempt %d", delay, b.attempt)
+	}
+}
+
+func TestDirectoryReloadsAtomically(t *testing.T) {
+	people := newSlackDirectory()
+	users := []slackUser{{Id: "U1", Name: "alice"}}
+	channels := []slackChannel{{Id: "C1", Name: "general"}}
+	people.load(users, channels)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			people.load(users, channels)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if id, err := people.resolveChannel("#general"); err != nil || id != "C1" {
+			t.Fatalf("Lookup during a reload failed: [%s] %v", id, err)
+		}
+		if id, err := people.resolveUser("@alice"); err != nil || id != "U1" {
+			t.Fatalf("Lookup during a reload failed: [%s] %v", id, err)
+		}
+	}
+}
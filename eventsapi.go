@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Slack rejects replays older than this, so we do too
+const slackSignatureMaxAge = 5 * time.Minute
+
+// Far more than any callback slack sends; anything bigger isn't read, let
+// alone verified
+const maxEventsApiBody = 1 << 20
+
+var (
+	// signed by one of our teams' apps, but for a team which isn't ours
+	errUnknownTeam = errors.New("team_id matches none of our teams")
+	// signed by one of our teams' apps, whose team we haven't identified yet
+	errTeamNotReady = errors.New("team not ready")
+)
+
+// Events API callbacks are either a one-off url_verification challenge or an
+// event_callback wrapping the same event RTM would have delivered.
+// {"type":"event_callback","team_id":"STRING","event":{"type":"message",...},"event_id":"STRING"}
+type slackEventsApiCallback struct {
+	Type      string        `json:"type"`
+	Challenge string        `json:"challenge,omitempty"`
+	TeamId    string        `json:"team_id,omitempty"`
+	EventId   string        `json:"event_id,omitempty"`
+	Event     slackRtmEvent `json:"event,omitempty"`
+}
+
+// Slack retries a callback for up to an hour when it thinks we missed it,
+// which is how long (or for how many events) we remember what we've handled
+const (
+	recentEventIdsFor = time.Hour
+	maxRecentEventIds = 1000
+)
+
+// recentEventIds are the event_ids a team has handled lately, oldest first
+type recentEventIds struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []string
+}
+
+func newRecentEventIds() *recentEventIds {
+	return &recentEventIds{seen: map[string]time.Time{}}
+}
+
+// firstSeen ...
+// Records id, returning false if it was already recorded (and hasn't expired)
+func (r *recentEventIds) firstSeen(id string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.order) > 0 && (len(r.order) >= maxRecentEventIds || now.Sub(r.seen[r.order[0]]) > recentEventIdsFor) {
+		delete(r.seen, r.order[0])
+		r.order = r.order[1:]
+	}
+	if _, ok := r.seen[id]; ok {
+		return false
+	}
+	r.seen[id] = now
+	r.order = append(r.order, id)
+	return true
+}
+
+// eventsApiReceiver accepts callbacks for every team using the events transport
+type eventsApiReceiver struct {
+	teams []*slackTeam
+}
+
+// verifySlackSignature ...
+// Checks the X-Slack-Signature header against our signing secret, per
+// https://api.slack.com/authentication/verifying-requests-from-slack
+func verifySlackSignature(header http.Header, body []byte, signingSecret string, now time.Time) error {
+	tsHeader := header.Get("X-Slack-Request-Timestamp")
+	ts, err := strconv.ParseInt(tsHeader, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid X-Slack-Request-Timestamp [%s]", tsHeader)
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > slackSignatureMaxAge || age < -slackSignatureMaxAge {
+		return fmt.Errorf("stale X-Slack-Request-Timestamp [%s]", tsHeader)
+	}
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	fmt.Fprintf(mac, "v0:%s:%s", tsHeader, body)
+	expected := fmt.Sprintf("v0=%s", hex.EncodeToString(mac.Sum(nil)))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("X-Slack-Signature mismatch")
+	}
+	return nil
+}
+
+// teamFor ...
+// Works out which of our teams sent a request: the one whose signing secret
+// it was signed with and whose team_id it carries. Only url_verification,
+// which is about the app rather than a team, comes without a team_id.
+func (receiver *eventsApiReceiver) teamFor(header http.Header, body []byte, teamId string) (*slackTeam, error) {
+	var verified []*slackTeam
+	var err error
+	for _, team := range receiver.teams {
+		if err = verifySlackSignature(header, body, team.config.SlackSigningSecret, time.Now()); err == nil {
+			verified = append(verified, team)
+		}
+	}
+	if len(verified) == 0 {
+		return nil, err
+	}
+	if len(teamId) == 0 {
+		return verified[0], nil
+	}
+	err = errUnknownTeam
+	for _, team := range verified {
+		switch team.self.team() {
+		case teamId:
+			return team, nil
+		case "":
+			// might be this one, once auth.test tells us
+			err = errTeamNotReady
+		}
+	}
+	return nil, err
+}
+
+// ServeHTTP ...
+func (receiver *eventsApiReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEventsApiBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "failed reading body", http.StatusBadRequest)
+		return
+	}
+	// Peek at the team before verifying; nothing is trusted until teamFor
+	// has checked the signature
+	var callback slackEventsApiCallback
+	jsonErr := json.Unmarshal(body, &callback)
+	team, err := receiver.teamFor(r.Header, body, callback.TeamId)
+	switch {
+	case err == errTeamNotReady:
+		// slack will retry
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err == errUnknownTeam:
+		log.Printf("Rejecting Events API request from [%s] for team [%s]: %s", r.RemoteAddr, callback.TeamId, err)
+		http.Error(w, "unknown team", http.StatusForbidden)
+		return
+	case err != nil:
+		log.Printf("Rejecting Events API request from [%s]: %s", r.RemoteAddr, err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	logDebug(fmt.Sprintf("received for team [%s]: %s", team.name(), body))
+	if jsonErr != nil {
+		log.Printf("Invalid json received from slack? [%s]", jsonErr)
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	switch callback.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, callback.Challenge)
+	case "event_callback":
+		if !team.conn.connected() {
+			// still authenticating, or given up on; slack will retry
+			http.Error(w, "team not ready", http.StatusServiceUnavailable)
+			return
+		}
+		if len(callback.EventId) > 0 && !team.recentEvents.firstSeen(callback.EventId, time.Now()) {
+			logDebug(fmt.Sprintf("Ignoring retry of event [%s] for team [%s]", callback.EventId, team.name()))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		// Slack retries unless we answer within 3 seconds, so don't make it
+		// wait on Jira
+		w.WriteHeader(http.StatusOK)
+		handleSlackEvent(team, callback.Event)
+	default:
+		logDebug(fmt.Sprintf("Ignoring Events API callback type [%s]", callback.Type))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// serveEventsApi ...
+// Listens for Slack Events API callbacks instead of holding a websocket open.
+// Teams authenticate in the background, so one slack can't reach doesn't keep
+// the listener down for the rest.
+func serveEventsApi(teams []*slackTeam) {
+	for _, team := range teams {
+		team.poster = newOutboundQueue(team.web.chatPostMessage, team.web, team.stop)
+		go startEventsTeam(team)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/slack/events", &eventsApiReceiver{teams})
+	server := &http.Server{Addr: config.EventsListenAddr, Handler: mux}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		// The listener is shared, so it stays up until every team is stopping
+		for _, team := range teams {
+			<-team.stop
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down the Events API listener: %s", err)
+		}
+	}()
+	log.Printf("Listening for Events API callbacks on [%s]...", config.EventsListenAddr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Shutdown returns once the requests in flight have been answered, after
+	// which no more work can be started
+	<-closed
+	var wg sync.WaitGroup
+	for _, team := range teams {
+		wg.Add(1)
+		go func(team *slackTeam) {
+			defer wg.Done()
+			team.finishWorkLogged()
+			if team.conn.connected() {
+				team.conn.set(connStateDisconnected)
+			}
+		}(team)
+	}
+	wg.Wait()
+}
+
+// startEventsTeam ...
+// Learns who we are in team, after which its events are accepted
+func startEventsTeam(team *slackTeam) {
+	team.conn.set(connStateConnecting)
+	err := retryWithBackoff(fmt.Sprintf("slack auth.test for team [%s]", team.name()), nil, team.stop, team.learnBotIdentity)
+	if err == errStopping {
+		// serveEventsApi does the rest of the shutting down
+		team.conn.set(connStateDisconnected)
+		return
+	} else if err != nil {
+		team.giveUp(err)
+		return
+	}
+	if err := team.loadDirectory(); err != nil {
+		log.Printf("Error loading users and channels for team [%s]: %s", team.name(), err)
+	}
+	// There's no connection to lose; we're as connected as we'll ever be
+	team.conn.set(connStateConnected)
+}
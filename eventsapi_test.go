@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSigningSecret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+// signedEventsRequest ...
+// A request to /slack/events signed with secret at ts, as slack would sign it
+func signedEventsRequest(body string, secret string, ts time.Time) *http.Request {
+	req := httptest.NewRequest("POST", "/slack/events", strings.NewReader(body))
+	tsHeader := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", tsHeader, body)
+	req.Header.Set("X-Slack-Request-Timestamp", tsHeader)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+// startEventsTeams ...
+// An events receiver for a team on each of fakes, all of them sharing one app
+// (and so its signing secret), once they've all authenticated
+func startEventsTeams(t *testing.T, fakes ...*fakeSlack) *eventsApiReceiver {
+	t.Helper()
+	receiver := &eventsApiReceiver{}
+	for i, fs := range fakes {
+		team := newSlackTeam(teamConfig{Name: fmt.Sprintf("%s-%d", t.Name(), i), SlackApiUrl: fs.url(),
+			SlackApiToken: "xoxb-test", JiraUrl: fs.url(), SlackSigningSecret: testSigningSecret})
+		team.store.DilbertBackOffUntil = time.Now().Add(time.Hour)
+		team.poster = newOutboundQueue(team.web.chatPostMessage, team.web, team.stop)
+		startEventsTeam(team)
+		if !team.conn.connected() {
+			t.Fatalf("Team [%s] didn't authenticate", team.name())
+		}
+		t.Cleanup(func() {
+			team.shutdown()
+			team.finishWork(time.Now().Add(fakeSlackTimeout))
+		})
+		receiver.teams = append(receiver.teams, team)
+	}
+	return receiver
+}
+
+func TestEventsApiSignatures(t *testing.T) {
+	receiver := startEventsTeams(t, newFakeSlack(t))
+	body := `{"type":"url_verification","challenge":"3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P"}`
+	for _, tc := range []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"valid", signedEventsRequest(body, testSigningSecret, time.Now()), http.StatusOK},
+		{"mismatched", signedEventsRequest(body, "not-our-secret", time.Now()), http.StatusUnauthorized},
+		{"stale", signedEventsRequest(body, testSigningSecret, time.Now().Add(-10*time.Minute)), http.StatusUnauthorized},
+		{"unsigned", httptest.NewRequest("POST", "/slack/events", strings.NewReader(body)), http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		receiver.ServeHTTP(w, tc.req)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected http code %d, got %d", tc.name, tc.status, w.Code)
+		}
+	}
+}
+
+func TestEventsApiUrlVerification(t *testing.T) {
+	receiver := startEventsTeams(t, newFakeSlack(t))
+	w := httptest.NewRecorder()
+	receiver.ServeHTTP(w, signedEventsRequest(`{"type":"url_verification","challenge":"abc123"}`, testSigningSecret, time.Now()))
+	if w.Code != http.StatusOK || w.Body.String() != "abc123" {
+		t.Errorf("Expected the challenge back, got %d [%s]", w.Code, w.Body.String())
+	}
+}
+
+func TestEventsApiRejectsOversizedBodies(t *testing.T) {
+	receiver := startEventsTeams(t, newFakeSlack(t))
+	body := fmt.Sprintf(`{"type":"url_verification","challenge":"%s"}`, strings.Repeat("x", maxEventsApiBody))
+	w := httptest.NewRecorder()
+	receiver.ServeHTTP(w, signedEventsRequest(body, testSigningSecret, time.Now()))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected http code %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func TestEventsApiDispatchesToTheEventsTeam(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-1", "Over HTTP")
+	receiver := startEventsTeams(t, fs)
+	w := httptest.NewRecorder()
+	receiver.ServeHTTP(w, signedEventsRequest(`{"type":"event_callback","team_id":"T1","event_id":"Ev1",`+
+		`"event":{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-1","ts":"1500000001.000001"}}`,
+		testSigningSecret, time.Now()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected http code 200, got %d", w.Code)
+	}
+	post := fs.awaitPost()
+	if post.Method != "chat.postMessage" || unfurlTitle(post) != "ABC-1: Over HTTP" {
+		t.Errorf("Unexpected reply [%s] via [%s]", unfurlTitle(post), post.Method)
+	}
+}
+
+func TestEventsApiRejectsEventsForOtherTeams(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-1", "Not for them")
+	receiver := startEventsTeams(t, fs)
+	w := httptest.NewRecorder()
+	receiver.ServeHTTP(w, signedEventsRequest(`{"type":"event_callback","team_id":"T9","event_id":"Ev1",`+
+		`"event":{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-1","ts":"1500000001.000001"}}`,
+		testSigningSecret, time.Now()))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected http code %d, got %d", http.StatusForbidden, w.Code)
+	}
+	fs.expectNoPost(200 * time.Millisecond)
+}
+
+func TestEventsApiIgnoresRetries(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-1", "Once only")
+	receiver := startEventsTeams(t, fs)
+	body := `{"type":"event_callback","team_id":"T1","event_id":"Ev1",` +
+		`"event":{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-1","ts":"1500000001.000001"}}`
+	for attempt := 1; attempt <= 2; attempt++ {
+		w := httptest.NewRecorder()
+		req := signedEventsRequest(body, testSigningSecret, time.Now())
+		if attempt > 1 {
+			req.Header.Set("X-Slack-Retry-Num", "1")
+		}
+		receiver.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected http code 200 for attempt %d, got %d", attempt, w.Code)
+		}
+	}
+	if post := fs.awaitPost(); unfurlTitle(post) != "ABC-1: Once only" {
+		t.Errorf("Unexpected reply [%s]", unfurlTitle(post))
+	}
+	fs.expectNoPost(1500 * time.Millisecond)
+}
+
+func TestRecentEventIdsForget(t *testing.T) {
+	recent := newRecentEventIds()
+	now := time.Now()
+	if !recent.firstSeen("Ev1", now) || recent.firstSeen("Ev1", now.Add(time.Minute)) {
+		t.Error("Expected a repeat to be spotted")
+	}
+	if !recent.firstSeen("Ev1", now.Add(recentEventIdsFor+time.Second)) {
+		t.Error("Expected an event to be forgotten once it's expired")
+	}
+	for i := 0; i < maxRecentEventIds; i++ {
+		recent.firstSeen(fmt.Sprintf("Ev%d", i+2), now)
+	}
+	if len(recent.seen) > maxRecentEventIds {
+		t.Errorf("Expected at most %d event_ids remembered, got %d", maxRecentEventIds, len(recent.seen))
+	}
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// How long tests wait for the bot to do something before failing
+const fakeSlackTimeout = 10 * time.Second
+
+// fakePost is something the bot said, however it said it
+type fakePost struct {
+	// "rtm", or the Web API method called (e.g. "chat.postMessage")
+	Method  string
+	Message slackMessage
+	// the request body, for Web API posts
+	Raw []byte
+}
+
+// fakeSlack is an in-process slack (rtm.start, the RTM websocket, Socket Mode
+// and enough of the Web API), plus the jira and dilbert.com endpoints the bot talks to.
+// Tests script inbound events with send and assert on what comes out of posts.
+type fakeSlack struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+	// rtm.start calls to fail before succeeding
+	rtmStartFailures int
+	rtmStarts        int
+	// don't answer pings, so the bot thinks the connection is dead. Socket
+	// Mode connections only stop reading (and so answering websocket pings)
+	// after the next frame the bot sends.
+	ignorePings bool
+	// hang up on every connection as soon as it's been greeted
+	dropAfterHello bool
+	lastTs         int
+	// apps.connections.open calls, and the envelope_ids Socket Mode clients acked
+	connectionsOpened int
+	acks              chan string
+
+	// signalled each time a connection has been greeted with hello, and
+	// each time one is closed
+	connected    chan struct{}
+	disconnected chan struct{}
+	posts        chan fakePost
+	// closed once the bot under test has returned
+	stopped chan struct{}
+	// jira issue key => summary
+	issues map[string]string
+	// issues asked for; jira doesn't answer for heldIssue until holdJira is closed
+	jiraRequests chan string
+	heldIssue    string
+	holdJira     chan struct{}
+	// the body of each comment added to an issue, by key
+	comments map[string][]string
+	// the fields of each issue created
+	created []map[string]interface{}
+	// POSTs to the jira API, whether they succeeded or not
+	jiraPosts int
+	// which createmeta endpoints jira has: "" for Data Center 9 (just the
+	// per-project one), "cloud" (both) or "legacy" (just ?projectKeys=)
+	jiraFlavor string
+	// requests made to the fake dilbert.com
+	strips chan string
+}
+
+func newFakeSlack(t *testing.T) *fakeSlack {
+	fs := &fakeSlack{
+		t:            t,
+		connected:    make(chan struct{}, 10),
+		disconnected: make(chan struct{}, 10),
+		posts:        make(chan fakePost, 100),
+		acks:         make(chan string, 100),
+		stopped:      make(chan struct{}),
+		issues:       map[string]string{},
+		comments:     map[string][]string{},
+		jiraRequests: make(chan string, 10),
+		strips:       make(chan string, 10),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rtm.start", fs.rtmStart)
+	mux.Handle("/ws", websocket.Handler(fs.serveRtm))
+	mux.HandleFunc("/apps.connections.open", fs.appsConnectionsOpen)
+	mux.Handle("/socketmode", websocket.Handler(fs.serveSocketMode))
+	mux.HandleFunc("/users.list", fs.usersList)
+	mux.HandleFunc("/conversations.list", fs.conversationsList)
+	for _, method := range []string{"chat.postMessage", "chat.update", "chat.delete"} {
+		mux.HandleFunc("/"+method, fs.chat)
+	}
+	mux.HandleFunc("/chat.getPermalink", fs.permalink)
+	mux.HandleFunc("/auth.test", fs.authTest)
+	mux.HandleFunc("/rest/api/latest/issue/", fs.jiraIssue)
+	mux.HandleFunc("/rest/api/latest/issue", fs.jiraCreate)
+	mux.HandleFunc("/strip/", fs.dilbertStrip)
+	fs.server = httptest.NewServer(fs.countJiraPosts(mux))
+	t.Cleanup(fs.close)
+	return fs
+}
+
+// url ...
+func (fs *fakeSlack) url() string {
+	return fs.server.URL
+}
+
+// close ...
+func (fs *fakeSlack) close() {
+	fs.dropConnection()
+	fs.server.Close()
+}
+
+// nextTs ...
+func (fs *fakeSlack) nextTs() string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.lastTs++
+	return fmt.Sprintf("1500000000.%06d", fs.lastTs)
+}
+
+func (fs *fakeSlack) rtmStart(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	fs.rtmStarts++
+	fail := fs.rtmStarts <= fs.rtmStartFailures
+	fs.mu.Unlock()
+	if fail {
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, `{"ok":true,"url":"%s/ws","self":{"id":"UBOT","name":"databot"},"team":{"id":"T1"},`+
+		`"users":[{"id":"U1","name":"alice"}],"channels":[{"id":"C1","name":"general"}]}`,
+		strings.Replace(fs.url(), "http", "ws", 1))
+}
+
+// serveRtm ...
+// Greets each connection, answers pings and acknowledges messages
+func (fs *fakeSlack) serveRtm(ws *websocket.Conn) {
+	fs.mu.Lock()
+	fs.conn = ws
+	fs.mu.Unlock()
+	defer func() {
+		fs.disconnected <- struct{}{}
+	}()
+	websocket.Message.Send(ws, `{"type":"hello"}`)
+	fs.connected <- struct{}{}
+	fs.mu.Lock()
+	drop := fs.dropAfterHello
+	fs.mu.Unlock()
+	if drop {
+		ws.Close()
+		return
+	}
+	for {
+		var frame []byte
+		if err := websocket.Message.Receive(ws, &frame); err != nil {
+			return
+		}
+		var event slackRtmEvent
+		if err := json.Unmarshal(frame, &event); err != nil {
+			fs.t.Errorf("Bot sent invalid json [%s]: %s", frame, err)
+			continue
+		}
+		switch event.Type {
+		case "ping":
+			fs.mu.Lock()
+			ignore := fs.ignorePings
+			fs.mu.Unlock()
+			if !ignore {
+				websocket.Message.Send(ws, fmt.Sprintf(`{"type":"pong","reply_to":%d}`, event.Id))
+			}
+		case "message":
+			ts := fs.nextTs()
+			fs.posts <- fakePost{Method: "rtm", Message: slackMessage{Channel: event.Channel, Text: event.Text, Ts: ts, ThreadTs: event.ThreadTs}}
+			websocket.Message.Send(ws, fmt.Sprintf(`{"ok":true,"reply_to":%d,"ts":"%s"}`, event.Id, ts))
+		default:
+			fs.t.Errorf("Bot sent unexpected frame [%s]", frame)
+		}
+	}
+}
+
+func (fs *fakeSlack) appsConnectionsOpen(w http.ResponseWriter, r *http.Request) {
+	if auth := r.Header.Get("Authorization"); auth != "Bearer xapp-test" {
+		fs.t.Errorf("apps.connections.open called with [%s] rather than the app-level token", auth)
+	}
+	fs.mu.Lock()
+	fs.connectionsOpened++
+	fs.mu.Unlock()
+	fmt.Fprintf(w, `{"ok":true,"url":"%s/socketmode"}`, strings.Replace(fs.url(), "http", "ws", 1))
+}
+
+// serveSocketMode ...
+// Greets each Socket Mode connection and collects the acks the bot sends
+func (fs *fakeSlack) serveSocketMode(ws *websocket.Conn) {
+	fs.mu.Lock()
+	fs.conn = ws
+	fs.mu.Unlock()
+	defer func() {
+		fs.disconnected <- struct{}{}
+	}()
+	websocket.Message.Send(ws, `{"type":"hello","num_connections":1}`)
+	fs.connected <- struct{}{}
+	for {
+		var frame []byte
+		if err := websocket.Message.Receive(ws, &frame); err != nil {
+			return
+		}
+		var ack socketModeAck
+		if err := json.Unmarshal(frame, &ack); err != nil || len(ack.EnvelopeId) == 0 {
+			fs.t.Errorf("Bot sent unexpected Socket Mode frame [%s]", frame)
+			continue
+		}
+		fs.acks <- ack.EnvelopeId
+		for {
+			fs.mu.Lock()
+			ignore := fs.ignorePings
+			fs.mu.Unlock()
+			if !ignore {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func (fs *fakeSlack) usersList(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, `{"ok":true,"members":[{"id":"U1","name":"alice"},{"id":"UBOT","name":"databot"}]}`)
+}
+
+func (fs *fakeSlack) conversationsList(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, `{"ok":true,"channels":[{"id":"C1","name":"general"}]}`)
+}
+
+func (fs *fakeSlack) chat(w http.ResponseWriter, r *http.Request) {
+	var msg slackMessage
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &msg); err != nil {
+		fs.t.Errorf("Bot sent invalid json to [%s]: %s", r.URL.Path, err)
+	}
+	method := strings.TrimPrefix(r.URL.Path, "/")
+	if method == "chat.postMessage" {
+		msg.Ts = fs.nextTs()
+	}
+	fs.posts <- fakePost{Method: method, Message: msg, Raw: body}
+	json.NewEncoder(w).Encode(slackChatResp{slackApiResp{Ok: true}, msg.Channel, msg.Ts})
+}
+
+// authTest ...
+func (fs *fakeSlack) authTest(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, `{"ok":true,"user_id":"UBOT","bot_id":"BBOT","team_id":"T1"}`)
+}
+
+// countJiraPosts ...
+func (fs *fakeSlack) countJiraPosts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/rest/") {
+			fs.mu.Lock()
+			fs.jiraPosts++
+			fs.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (fs *fakeSlack) permalink(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, `{"ok":true,"permalink":"https://example.slack.com/archives/%s/p%s"}`,
+		r.FormValue("channel"), strings.Replace(r.FormValue("message_ts"), ".", "", 1))
+}
+
+func (fs *fakeSlack) jiraIssue(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/rest/api/latest/issue/")
+	if key, isComment := strings.CutSuffix(key, "/comment"); isComment && r.Method == "POST" {
+		fs.jiraComment(w, r, key)
+		return
+	}
+	if key == "createmeta" {
+		fs.jiraCreateMeta(w, r)
+		return
+	}
+	if project, isIssueTypes := strings.CutSuffix(strings.TrimPrefix(key, "createmeta/"), "/issuetypes"); isIssueTypes {
+		fs.jiraIssueTypes(w, r, project)
+		return
+	}
+	fs.jiraRequests <- key
+	fs.mu.Lock()
+	summary, ok := fs.issues[key]
+	held := key == fs.heldIssue
+	fs.mu.Unlock()
+	if held {
+		<-fs.holdJira
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var issue jiraIssueResp
+	issue.Key = key
+	issue.Fields.Summary = summary
+	issue.Fields.Description.Wiki = fmt.Sprintf("All about %s", key)
+	issue.Fields.Status.Name = "In Progress"
+	issue.Fields.Status.StatusCategory.Key = "indeterminate"
+	issue.Fields.IssueType.Name = "Bug"
+	issue.Fields.Assignee = &jiraUser{Name: "alice", DisplayName: "Alice Example"}
+	issue.Fields.Created = "2017-06-20T11:05:09.000+0000"
+	issue.Fields.Updated = "2017-06-21T08:00:00.000+0000"
+	json.NewEncoder(w).Encode(issue)
+}
+
+// jiraComment ...
+func (fs *fakeSlack) jiraComment(w http.ResponseWriter, r *http.Request, key string) {
+	var comment struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&comment); err != nil {
+		fs.t.Errorf("Bot sent an invalid comment: %s", err)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.issues[key]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errorMessages":["Issue does not exist or you do not have permission to see it."],"errors":{}}`)
+		return
+	}
+	fs.comments[key] = append(fs.comments[key], comment.Body)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"id":"%d","body":%q}`, 10000+len(fs.comments[key]), comment.Body)
+}
+
+// jiraCreateMeta ...
+// Only project ABC exists
+func (fs *fakeSlack) jiraCreateMeta(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	flavor := fs.jiraFlavor
+	fs.mu.Unlock()
+	if flavor == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.FormValue("projectKeys") != "ABC" {
+		fmt.Fprint(w, `{"projects":[]}`)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"projects": []interface{}{map[string]interface{}{"key": "ABC", "name": "Alphabet", "issuetypes": fakeIssueTypes}},
+	})
+}
+
+// The issue types of project ABC
+var fakeIssueTypes = []jiraIssueType{{"1", "Bug", false}, {"2", "New Feature", false}, {"3", "New", false}, {"4", "Sub-task", true}}
+
+// jiraIssueTypes ...
+// issue/createmeta/{project}/issuetypes, two to a page
+func (fs *fakeSlack) jiraIssueTypes(w http.ResponseWriter, r *http.Request, project string) {
+	fs.mu.Lock()
+	flavor := fs.jiraFlavor
+	fs.mu.Unlock()
+	if flavor == "legacy" || project != "ABC" {
+		http.NotFound(w, r)
+		return
+	}
+	startAt, _ := strconv.Atoi(r.FormValue("startAt"))
+	end := startAt + 2
+	if end > len(fakeIssueTypes) {
+		end = len(fakeIssueTypes)
+	}
+	page := map[string]interface{}{"startAt": startAt, "maxResults": 2, "total": len(fakeIssueTypes)}
+	if flavor == "cloud" {
+		page["issueTypes"] = fakeIssueTypes[startAt:end]
+	} else {
+		page["values"] = fakeIssueTypes[startAt:end]
+		page["isLast"] = end == len(fakeIssueTypes)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// jiraCreate ...
+// Insists on a summary under 40 characters
+func (fs *fakeSlack) jiraCreate(w http.ResponseWriter, r *http.Request) {
+	var issue struct {
+		Fields map[string]interface{} `json:"fields"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&issue); err != nil {
+		fs.t.Errorf("Bot sent an invalid issue: %s", err)
+	}
+	if summary, _ := issue.Fields["summary"].(string); len(summary) >= 40 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"errorMessages":[],"errors":{"summary":"Summary must be less than 40 characters."}}`)
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.created = append(fs.created, issue.Fields)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"id":"%d","key":"ABC-%d"}`, 20000+len(fs.created), 100+len(fs.created))
+}
+
+func (fs *fakeSlack) dilbertStrip(w http.ResponseWriter, r *http.Request) {
+	fs.strips <- r.URL.Path
+	fmt.Fprint(w, "<html>today's strip</html>")
+}
+
+// addIssue ...
+func (fs *fakeSlack) addIssue(key string, summary string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.issues[key] = summary
+}
+
+// send ...
+// Delivers event to the bot over the current connection
+func (fs *fakeSlack) send(event string) {
+	fs.mu.Lock()
+	ws := fs.conn
+	fs.mu.Unlock()
+	if ws == nil {
+		fs.t.Fatalf("Can't send [%s]; the bot isn't connected", event)
+	}
+	if err := websocket.Message.Send(ws, event); err != nil {
+		fs.t.Fatalf("Error sending [%s]: %s", event, err)
+	}
+}
+
+// sendFragmented ...
+// send, with event split across pieces websocket frames: a text frame
+// followed by continuation frames, as slack does with large events
+func (fs *fakeSlack) sendFragmented(event string, pieces int) {
+	fs.mu.Lock()
+	ws := fs.conn
+	fs.mu.Unlock()
+	if ws == nil {
+		fs.t.Fatalf("Can't send [%s]; the bot isn't connected", event)
+	}
+	size := (len(event) + pieces - 1) / pieces
+	ws.PayloadType = websocket.TextFrame
+	for start := 0; start < len(event); start += size {
+		end := start + size
+		if end > len(event) {
+			end = len(event)
+		}
+		if _, err := ws.Write([]byte(event[start:end])); err != nil {
+			fs.t.Fatalf("Error sending part of [%s]: %s", event, err)
+		}
+		ws.PayloadType = websocket.ContinuationFrame
+	}
+}
+
+// dropConnection ...
+// Hangs up on the bot, as a flaky network would
+func (fs *fakeSlack) dropConnection() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.conn != nil {
+		fs.conn.Close()
+		fs.conn = nil
+	}
+}
+
+// awaitAck ...
+// Waits for the bot to acknowledge a Socket Mode envelope, returning its id
+func (fs *fakeSlack) awaitAck() string {
+	fs.t.Helper()
+	select {
+	case id := <-fs.acks:
+		return id
+	case <-time.After(fakeSlackTimeout):
+		fs.t.Fatal("Timed out waiting for the bot to acknowledge an envelope")
+	}
+	return ""
+}
+
+// awaitConnection ...
+func (fs *fakeSlack) awaitConnection() {
+	fs.t.Helper()
+	select {
+	case <-fs.connected:
+	case <-time.After(fakeSlackTimeout):
+		fs.t.Fatal("Timed out waiting for the bot to connect")
+	}
+}
+
+// holdIssue ...
+// Makes jira sit on requests for key until the returned func is called
+func (fs *fakeSlack) holdIssue(key string) func() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.heldIssue = key
+	fs.holdJira = make(chan struct{})
+	return func() {
+		close(fs.holdJira)
+	}
+}
+
+// awaitJiraRequest ...
+// Waits for the bot to ask jira about key
+func (fs *fakeSlack) awaitJiraRequest(key string) {
+	fs.t.Helper()
+	for {
+		select {
+		case requested := <-fs.jiraRequests:
+			if requested == key {
+				return
+			}
+		case <-time.After(fakeSlackTimeout):
+			fs.t.Fatalf("Timed out waiting for the bot to ask jira about [%s]", key)
+		}
+	}
+}
+
+// awaitStopped ...
+func (fs *fakeSlack) awaitStopped() {
+	fs.t.Helper()
+	select {
+	case <-fs.stopped:
+	case <-time.After(fakeSlackTimeout):
+		fs.t.Fatal("Timed out waiting for the bot to shut down")
+	}
+}
+
+// awaitPost ...
+func (fs *fakeSlack) awaitPost() fakePost {
+	fs.t.Helper()
+	select {
+	case post := <-fs.posts:
+		return post
+	case <-time.After(fakeSlackTimeout):
+		fs.t.Fatal("Timed out waiting for the bot to post")
+	}
+	return fakePost{}
+}
+
+// unfurlTitle ...
+// The title of the jira card in post, or its text if it isn't one
+func unfurlTitle(post fakePost) string {
+	if len(post.Message.Attachments) == 0 {
+		return post.Message.Text
+	}
+	return post.Message.Attachments[0].Title
+}
+
+// expectNoPost ...
+// Fails if the bot says anything within wait
+func (fs *fakeSlack) expectNoPost(wait time.Duration) {
+	fs.t.Helper()
+	select {
+	case post := <-fs.posts:
+		fs.t.Fatalf("Unexpected post %+v", post)
+	case <-time.After(wait):
+	}
+}
+
+// startBot ...
+// Connects a team to fs over RTM, returning once slack has said hello. Dilbert
+// stays quiet unless teamConf names a channel for it. The bot is shut down
+// when the test ends.
+func (fs *fakeSlack) startBot(teamConf teamConfig) *slackTeam {
+	fs.t.Helper()
+	return fs.startBotWith(teamConf, connectToSlack)
+}
+
+// startSocketModeBot ...
+// startBot, connecting over Socket Mode
+func (fs *fakeSlack) startSocketModeBot(teamConf teamConfig) *slackTeam {
+	fs.t.Helper()
+	teamConf.SlackTransport = transportSocketMode
+	teamConf.SlackAppToken = "xapp-test"
+	return fs.startBotWith(teamConf, connectToSlackSocketMode)
+}
+
+// startBotWith ...
+func (fs *fakeSlack) startBotWith(teamConf teamConfig, run func(*slackTeam)) *slackTeam {
+	fs.t.Helper()
+	teamConf.Name = fs.t.Name()
+	teamConf.SlackApiUrl = fs.url()
+	teamConf.SlackApiToken = "xoxb-test"
+	teamConf.JiraUrl = fs.url()
+	team := newSlackTeam(teamConf)
+	if len(teamConf.SlackDilbertChannel) == 0 {
+		// most tests have no interest in dilbert
+		team.store.DilbertBackOffUntil = time.Now().Add(time.Hour)
+	}
+	go func() {
+		defer close(fs.stopped)
+		run(team)
+	}()
+	fs.t.Cleanup(func() {
+		team.shutdown()
+		fs.awaitStopped()
+	})
+	fs.awaitConnection()
+	return team
+}
+
+func TestMain(m *testing.M) {
+	var err error
+	if homeEtcDir, err = ioutil.TempDir("", "databot-test"); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating temporary directory: %s\n", err)
+		os.Exit(1)
+	}
+	config.RtmPingInterval = 1
+	registerDefaultHandlers()
+	code := m.Run()
+	os.RemoveAll(homeEtcDir)
+	os.Exit(code)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventHandler is a feature which reacts to slack events. It replies through
+// team.poster, in the team the event came from. ctx is done once the handler's
+// time is up; it should then give up, without replying, since the events
+// behind it in the channel have moved on.
+type eventHandler interface {
+	handleEvent(ctx context.Context, team *slackTeam, slackEvent slackRtmEvent)
+}
+
+// eventHandlerFunc lets a plain function be an eventHandler
+type eventHandlerFunc func(ctx context.Context, team *slackTeam, slackEvent slackRtmEvent)
+
+func (f eventHandlerFunc) handleEvent(ctx context.Context, team *slackTeam, slackEvent slackRtmEvent) {
+	f(ctx, team, slackEvent)
+}
+
+// handlerRegistration describes which events a handler wants
+type handlerRegistration struct {
+	name    string
+	handler eventHandler
+	// "type" matches every event of that type; "type/subtype" only that
+	// subtype, with "type/" meaning no subtype at all. Empty matches everything.
+	events []string
+	// when set, only events whose text matches are delivered
+	pattern *regexp.Regexp
+	// handlers run in ascending order
+	order int
+	// how long the handler may take over one event; 0 uses config.HandlerTimeout
+	timeout time.Duration
+	enabled bool
+}
+
+// handlerRegistry dispatches each event to every interested, enabled handler
+type handlerRegistry struct {
+	mu       sync.RWMutex
+	handlers []*handlerRegistration
+}
+
+var handlers = &handlerRegistry{}
+
+// How long a handler gets with an event unless it (or the config) says otherwise
+const defaultHandlerTimeout = 60 * time.Second
+
+// registerDefaultHandlers ...
+// Every feature the bot ships with; config.DisabledHandlers turns them off
+func registerDefaultHandlers() {
+	handlers.register(handlerRegistration{
+		name:    "directory",
+		handler: eventHandlerFunc(processDirectoryEvent),
+		events: []string{"user_change", "team_join", "channel_created", "channel_rename", "group_rename",
+			"channel_deleted", "channel_archive", "group_archive"},
+		order: 0,
+	})
+	handlers.register(handlerRegistration{
+		name:    "dilbert",
+		handler: eventHandlerFunc(dilbertHandler),
+		order:   10,
+		timeout: 10 * time.Second,
+	})
+	handlers.register(handlerRegistration{
+		name:    "jira",
+		handler: eventHandlerFunc(processJiraReq),
+		events:  []string{"message"},
+		// jira#KEY-1, or maybe a bare KEY-1
+		pattern: regexp.MustCompile("jira#|[A-Z][A-Z0-9_]*-[0-9]"),
+		order:   20,
+	})
+	handlers.register(handlerRegistration{
+		name:    "jira-comment",
+		handler: eventHandlerFunc(processJiraComment),
+		events:  []string{"message/"},
+		pattern: jiraCommentRe,
+		order:   22,
+	})
+	handlers.register(handlerRegistration{
+		name:    "jira-create",
+		handler: eventHandlerFunc(processJiraCreate),
+		events:  []string{"message/"},
+		pattern: jiraCreateRe,
+		order:   23,
+	})
+	handlers.register(handlerRegistration{
+		name:    "jira-edits",
+		handler: eventHandlerFunc(processJiraEdit),
+		events:  []string{"message/message_changed", "message/message_deleted"},
+		order:   21,
+	})
+	for _, name := range config.DisabledHandlers {
+		if err := handlers.setEnabled(name, false); err != nil {
+			log.Printf("Can't disable handler: %s", err)
+		}
+	}
+}
+
+// register ...
+// Adds a handler, enabled. Names must be unique.
+func (r *handlerRegistry) register(reg handlerRegistration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.handlers {
+		if existing.name == reg.name {
+			log.Fatal(fmt.Sprintf("Handler [%s] registered twice", reg.name))
+		}
+	}
+	reg.enabled = true
+	r.handlers = append(r.handlers, &reg)
+	sort.SliceStable(r.handlers, func(i, j int) bool {
+		return r.handlers[i].order < r.handlers[j].order
+	})
+}
+
+// setEnabled ...
+func (r *handlerRegistry) setEnabled(name string, enabled bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, reg := range r.handlers {
+		if reg.name == name {
+			reg.enabled = enabled
+			return nil
+		}
+	}
+	return fmt.Errorf("no handler named [%s]", name)
+}
+
+// isEnabled ...
+func (r *handlerRegistry) isEnabled(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, reg := range r.handlers {
+		if reg.name == name {
+			return reg.enabled
+		}
+	}
+	return false
+}
+
+// wants ...
+func (reg *handlerRegistration) wants(slackEvent slackRtmEvent) bool {
+	if !reg.enabled {
+		return false
+	}
+	if len(reg.events) > 0 {
+		matched := false
+		for _, spec := range reg.events {
+			eventType, subtype, hasSubtype := strings.Cut(spec, "/")
+			if eventType == slackEvent.Type && (!hasSubtype || subtype == slackEvent.Subtype) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if reg.pattern != nil && !reg.pattern.MatchString(slackEvent.Text) {
+		return false
+	}
+	return true
+}
+
+// dispatch ...
+// Runs every interested handler against a single event, in order
+func (r *handlerRegistry) dispatch(team *slackTeam, slackEvent slackRtmEvent) {
+	if team.ignoreMessage(slackEvent) {
+		logDebug(fmt.Sprintf("Ignoring message from user [%s] bot [%s]", slackEvent.User, slackEvent.BotId))
+		return
+	}
+	r.mu.RLock()
+	var interested []*handlerRegistration
+	for _, reg := range r.handlers {
+		if reg.wants(slackEvent) {
+			interested = append(interested, reg)
+		}
+	}
+	r.mu.RUnlock()
+	for _, reg := range interested {
+		reg.run(team, slackEvent)
+	}
+}
+
+// run ...
+// Calls the handler, making sure a panic in one feature doesn't take the bot
+// down and a hung one doesn't hold up the events behind it. A handler which
+// runs out of time is cancelled, and still counts as work in progress until
+// it returns, so shutting down waits for it.
+func (reg *handlerRegistration) run(team *slackTeam, slackEvent slackRtmEvent) {
+	timeout := reg.timeout
+	if timeout == 0 {
+		timeout = handlerTimeout()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	finished := make(chan struct{})
+	team.work.Add(1)
+	go func() {
+		defer team.work.Done()
+		defer close(finished)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Handler [%s] panicked in team [%s]: %v\n%s", reg.name, team.name(), r, debug.Stack())
+			}
+		}()
+		reg.handler.handleEvent(ctx, team, slackEvent)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		log.Printf("Handler [%s] in team [%s] still running after %s; cancelled it and moving on", reg.name, team.name(), timeout)
+	}
+}
+
+// handlerCancelled ...
+// True once ctx is done, logging that what the handler had to say is dropped
+func handlerCancelled(ctx context.Context, team *slackTeam, what string) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	log.Printf("Not posting %s in team [%s]: %s", what, team.name(), ctx.Err())
+	return true
+}
+
+// handlerTimeout ...
+func handlerTimeout() time.Duration {
+	if config.HandlerTimeout > 0 {
+		return time.Duration(config.HandlerTimeout) * time.Second
+	}
+	return defaultHandlerTimeout
+}
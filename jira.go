@@ -2,46 +2,138 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
 type jiraIssueResp struct {
+	Key    string `json:"key"`
 	Fields struct {
-		Assignee struct {
-			Name string `json:"name,omitempty"`
-		}
-		Summary     string `json:"summary,omitempty"`
-		Description string `json:"description,omitempty"`
+		Summary     string          `json:"summary,omitempty"`
+		Description jiraDescription `json:"description"`
+		Status      struct {
+			Name string `json:"name"`
+			// "new", "indeterminate" or "done"
+			StatusCategory struct {
+				Key  string `json:"key"`
+				Name string `json:"name"`
+			} `json:"statusCategory"`
+		} `json:"status"`
+		IssueType struct {
+			Name string `json:"name"`
+		} `json:"issuetype"`
+		// Unassigned issues, and projects without priorities, have null here
+		Priority    *jiraNamed  `json:"priority,omitempty"`
+		Assignee    *jiraUser   `json:"assignee,omitempty"`
+		Reporter    *jiraUser   `json:"reporter,omitempty"`
+		Labels      []string    `json:"labels,omitempty"`
+		FixVersions []jiraNamed `json:"fixVersions,omitempty"`
+		// e.g. "2017-06-20T11:05:09.000+0000"
+		Created string `json:"created,omitempty"`
+		Updated string `json:"updated,omitempty"`
 	} `json:"fields"`
 }
 
-func getJiraIssues(readFromSlack []byte) ([]string, string, error) {
-	var slackEvent slackRtmEvent
-	readFromSlack = bytes.Trim(readFromSlack, "\x00")
-	err := json.Unmarshal(readFromSlack, &slackEvent)
-	if err != nil {
-		return []string{}, slackEvent.Channel, fmt.Errorf("uh, someone cant JSON :/\n%s", err)
+type jiraNamed struct {
+	Name string `json:"name"`
+}
+
+type jiraUser struct {
+	Name        string `json:"name,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// The layout of jira's created and updated dates
+const jiraTimeLayout = "2006-01-02T15:04:05.000-0700"
+
+// Attachment colors for each status category, as jira itself shows them
+var jiraStatusColors = map[string]string{
+	"new":           "#42526e",
+	"indeterminate": "#0052cc",
+	"done":          "#00875a",
+}
+
+var (
+	// jira#OPS-1423; the key is the first submatch
+	jiraIssueRe = regexp.MustCompile(`jira#([A-Za-z][A-Za-z0-9_]*-[0-9]+)`)
+	// OPS-1423 on its own; the project is the first submatch
+	bareJiraIssueRe = regexp.MustCompile(`\b([A-Z][A-Z0-9_]*)-[0-9]+\b`)
+	// Code blocks, inline code, links and bare urls, none of which are
+	// searched for bare keys
+	notJiraIssuesRe = regexp.MustCompile("(?s)```.*?```|`[^`\n]*`|<[^>]*>|https?://\\S+")
+)
+
+// getJiraIssues ...
+// The keys of every jira#KEY in the message. An error only when there's a
+// jira# without a valid key.
+func getJiraIssues(slackEvent slackRtmEvent) ([]string, error) {
+	if !isJiraIssueUrlRequest(slackEvent) {
+		return nil, nil
+	}
+	var jiraIssues []string
+	for _, match := range jiraIssueRe.FindAllStringSubmatch(slackEvent.Text, -1) {
+		jiraIssues = append(jiraIssues, match[1])
 	}
-	re := regexp.MustCompile("jira#[A-z]+-[0-9]+")
-	jiraIssues := re.FindAllString(slackEvent.Text, -1)
 	if len(jiraIssues) == 0 {
-		return []string{}, slackEvent.Channel, fmt.Errorf("that appears to be an invalid Jira issue :-1:")
+		return []string{}, fmt.Errorf("that appears to be an invalid Jira issue :-1:")
 	}
-	return jiraIssues, slackEvent.Channel, nil
+	return jiraIssues, nil
 }
 
-func isJiraIssueUrlRequest(readFromSlack []byte) bool {
-	var slackEvent slackRtmEvent
-	readFromSlack = bytes.Trim(readFromSlack, "\x00")
-	err := json.Unmarshal(readFromSlack, &slackEvent)
-	// This is here because it will fail to json decode non message type events with the given reference
-	if err != nil {
-		logDebug(fmt.Sprintf("Failed json decoding: [%s]", readFromSlack))
-	} else if len(slackEvent.Text) > 0 {
+// getBareJiraIssues ...
+// The keys mentioned in text without a jira# in front, from projects only.
+// Anything in code or a link is left alone.
+func getBareJiraIssues(text string, projects []string) []string {
+	text = notJiraIssuesRe.ReplaceAllString(text, " ")
+	var jiraIssues []string
+	for _, match := range bareJiraIssueRe.FindAllStringSubmatchIndex(text, -1) {
+		// skip the ones which were jira#KEY after all
+		if match[0] > 0 && text[match[0]-1] == '#' {
+			continue
+		}
+		project := text[match[2]:match[3]]
+		for _, allowed := range projects {
+			if project == allowed {
+				jiraIssues = append(jiraIssues, text[match[0]:match[1]])
+				break
+			}
+		}
+	}
+	return jiraIssues
+}
+
+// jiraIssuesMentioned ...
+// Every issue slackEvent asks about, in order and once each: jira#KEY
+// anywhere, bare keys too where the channel wants them
+func (team *slackTeam) jiraIssuesMentioned(slackEvent slackRtmEvent) ([]string, error) {
+	jiraIssues, err := getJiraIssues(slackEvent)
+	if team.channelSettings(slackEvent.Channel).BareJiraKeys {
+		jiraIssues = append(jiraIssues, getBareJiraIssues(slackEvent.Text, team.config.JiraProjects)...)
+	}
+	var unique []string
+	seen := map[string]bool{}
+	for _, jiraIssue := range jiraIssues {
+		if key := strings.ToUpper(jiraIssue); !seen[key] {
+			seen[key] = true
+			unique = append(unique, jiraIssue)
+		}
+	}
+	if len(unique) > 0 {
+		return unique, nil
+	}
+	return nil, err
+}
+
+func isJiraIssueUrlRequest(slackEvent slackRtmEvent) bool {
+	if len(slackEvent.Text) > 0 {
 		logDebug(fmt.Sprintf("Comparing message event text field: [%s]", slackEvent.Text))
 		jiraLinkRequested, _ := regexp.MatchString("jira#.*", slackEvent.Text)
 		if jiraLinkRequested {
@@ -51,10 +143,7 @@ func isJiraIssueUrlRequest(readFromSlack []byte) bool {
 	return false
 }
 
-func jiraIssueDescriptionRequested(readFromSlack []byte) bool {
-	var slackEvent slackRtmEvent
-	readFromSlack = bytes.Trim(readFromSlack, "\x00")
-	json.Unmarshal(readFromSlack, &slackEvent)
+func jiraIssueDescriptionRequested(slackEvent slackRtmEvent) bool {
 	// Only message events have the Text field.
 	if len(slackEvent.Text) > 0 {
 		r, _ := regexp.Compile(`jira#\S+\.describe`)
@@ -67,29 +156,186 @@ func jiraIssueDescriptionRequested(readFromSlack []byte) bool {
 	return false
 }
 
-func getJiraIssueDetails(jiraIssue string) (string, string, error) {
-	hClient := &http.Client{}
-	jiraReqUrl := fmt.Sprintf("%s/rest/api/latest/issue/%s", config.JiraUrl, jiraIssue)
+// Used unless config.HttpTimeout says otherwise
+const defaultJiraTimeout = 15 * time.Second
+
+// newJiraHttpClient ...
+// Jira can be slow, but mustn't hold up a worker forever
+func newJiraHttpClient() *http.Client {
+	timeout := defaultJiraTimeout
+	if config.HttpTimeout > 0 {
+		timeout = time.Duration(config.HttpTimeout) * time.Second
+	}
+	return &http.Client{Timeout: timeout}
+}
+
+// jiraErrorResp is how jira explains a request it refused
+type jiraErrorResp struct {
+	ErrorMessages []string          `json:"errorMessages"`
+	Errors        map[string]string `json:"errors"`
+}
+
+// jiraCall ...
+// A REST API call (path is relative to /rest/api/latest) made with the team's
+// credentials, abandoned should ctx be done first. payload, unless nil, is sent
+// as JSON; the response is decoded into result unless that's nil.
+func jiraCall(ctx context.Context, team *slackTeam, method string, path string, payload interface{}, result interface{}) error {
+	hClient := newJiraHttpClient()
+	jiraReqUrl := fmt.Sprintf("%s/rest/api/latest/%s", team.config.JiraUrl, path)
 	logDebug(fmt.Sprintf("JIRA URL: %s", jiraReqUrl))
-	req, err := http.NewRequest("GET", jiraReqUrl, nil)
-	req.SetBasicAuth(config.JiraUser, config.JiraPass)
+	var body io.Reader
+	if payload != nil {
+		jPayload, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("Error encoding request body: %s", err)
+		}
+		body = bytes.NewReader(jPayload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, jiraReqUrl, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(team.config.JiraUser, team.config.JiraPass)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	resp, err := hClient.Do(req)
 	if err != nil {
-		return "", "", err
+		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return "", "", fmt.Errorf(fmt.Sprintf("got non-200 http code: [%d]", resp.StatusCode))
-	}
 	bsRb, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newJiraHttpError(resp.StatusCode, bsRb)
+	}
 	if err != nil {
-		return "", "", fmt.Errorf(fmt.Sprintf("Error reading response body: %s", err))
+		return fmt.Errorf("Error reading response body: %s", err)
+	}
+	if result == nil {
+		return nil
 	}
 	// json decode
+	if jsonDecodeErr := json.Unmarshal(bsRb, result); jsonDecodeErr != nil {
+		return fmt.Errorf("Error JSON decoding response body: %s", jsonDecodeErr)
+	}
+	return nil
+}
+
+// jiraHttpError is a request jira refused, with whatever it said about why
+type jiraHttpError struct {
+	Code    int
+	Reasons []string
+}
+
+// newJiraHttpError ...
+func newJiraHttpError(code int, body []byte) *jiraHttpError {
+	var jr jiraErrorResp
+	json.Unmarshal(body, &jr)
+	reasons := jr.ErrorMessages
+	var fields []string
+	for field := range jr.Errors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", field, jr.Errors[field]))
+	}
+	return &jiraHttpError{Code: code, Reasons: reasons}
+}
+
+// Error ...
+func (e *jiraHttpError) Error() string {
+	if len(e.Reasons) == 0 {
+		return fmt.Sprintf("got non-200 http code: [%d]", e.Code)
+	}
+	return fmt.Sprintf("got non-200 http code: [%d] (%s)", e.Code, strings.Join(e.Reasons, "; "))
+}
+
+// getJiraIssue ...
+func getJiraIssue(ctx context.Context, team *slackTeam, jiraIssue string) (jiraIssueResp, error) {
 	var jr jiraIssueResp
-	jsonDecodeErr := json.Unmarshal(bsRb, &jr)
-	if jsonDecodeErr != nil {
-		return "", "", fmt.Errorf(fmt.Sprintf("Error JSON decoding response body: %s", jsonDecodeErr))
+	if err := jiraCall(ctx, team, "GET", "issue/"+jiraIssue, nil, &jr); err != nil {
+		return jr, err
+	}
+	if len(jr.Key) == 0 {
+		jr.Key = jiraIssue
+	}
+	return jr, nil
+}
+
+// jiraIssueUnfurl ...
+// A compact card for issue: its summary linking to it, colored by status,
+// with the fields people usually go and look up
+func jiraIssueUnfurl(jiraUrl string, issue jiraIssueResp, people *slackDirectory) slackMessage {
+	fields := issue.Fields
+	attachment := slackAttachment{
+		Fallback:  fmt.Sprintf("[%s] %s (%s)", issue.Key, fields.Summary, fields.Status.Name),
+		Color:     jiraStatusColors[fields.Status.StatusCategory.Key],
+		Title:     fmt.Sprintf("%s: %s", issue.Key, fields.Summary),
+		TitleLink: fmt.Sprintf("%s/browse/%s", jiraUrl, issue.Key),
+	}
+	addField := func(title string, value string) {
+		if len(value) > 0 {
+			attachment.Fields = append(attachment.Fields, slackAttachmentField{Title: title, Value: value, Short: true})
+		}
+	}
+	addField("Status", fields.Status.Name)
+	addField("Type", fields.IssueType.Name)
+	if fields.Priority != nil {
+		addField("Priority", fields.Priority.Name)
+	}
+	assignee := "Unassigned"
+	if fields.Assignee != nil {
+		assignee = fields.Assignee.slackName(people)
+	}
+	addField("Assignee", assignee)
+	if fields.Reporter != nil {
+		addField("Reporter", fields.Reporter.slackName(people))
+	}
+	addField("Labels", strings.Join(fields.Labels, ", "))
+	var versions []string
+	for _, version := range fields.FixVersions {
+		versions = append(versions, version.Name)
+	}
+	addField("Fix versions", strings.Join(versions, ", "))
+
+	var dates []string
+	if created := jiraDate(fields.Created); len(created) > 0 {
+		dates = append(dates, fmt.Sprintf("Created %s", created))
+	}
+	if updated := jiraDate(fields.Updated); len(updated) > 0 {
+		dates = append(dates, fmt.Sprintf("Updated %s", updated))
+	}
+	attachment.Footer = strings.Join(dates, " · ")
+	return slackMessage{Attachments: []slackAttachment{attachment}}
+}
+
+// displayName ...
+func (user *jiraUser) displayName() string {
+	if len(user.DisplayName) > 0 {
+		return user.DisplayName
+	}
+	return user.Name
+}
+
+// slackName ...
+// A mention of whoever in slack has the same username as user in jira, or
+// failing that, user's name
+func (user *jiraUser) slackName(people *slackDirectory) string {
+	if len(user.Name) > 0 {
+		if mention, ok := people.mention("@" + user.Name); ok {
+			return mention
+		}
+	}
+	return user.displayName()
+}
+
+// jiraDate ...
+// Just the day from one of jira's timestamps; empty if it can't be parsed
+func jiraDate(timestamp string) string {
+	parsed, err := time.Parse(jiraTimeLayout, timestamp)
+	if err != nil {
+		return ""
 	}
-	return jr.Fields.Summary, jr.Fields.Description, nil
+	return parsed.Format("2006-01-02")
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+var (
+	// jira#KEY.comment, then the comment, which runs to the end of the message
+	jiraCommentRe = regexp.MustCompile(`(?s)^\s*jira#([A-Za-z][A-Za-z0-9_]*-[0-9]+)\.comment\s+(\S.*)$`)
+
+	// slack's markup for mentions and links: <@U1>, <#C1|general>, <!here>, <url|text>
+	slackMarkupRe    = regexp.MustCompile(`<([@#!]?)([^<>|]*)(?:\|([^<>]*))?>`)
+	slackCodeBlockRe = regexp.MustCompile("(?s)```\n?(.*?)\n?```")
+	slackCodeRe      = regexp.MustCompile("`([^`\n]+)`")
+	slackStrikeRe    = regexp.MustCompile(`(^|\s)~([^~\s](?:[^~\n]*[^~\s])?)~`)
+	slackUnescaper   = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+)
+
+type jiraCommentResp struct {
+	Id string `json:"id"`
+}
+
+// getJiraComment ...
+// The issue and text of a jira#KEY.comment command, if slackEvent is one
+func getJiraComment(slackEvent slackRtmEvent) (string, string, bool) {
+	match := jiraCommentRe.FindStringSubmatch(slackEvent.Text)
+	if match == nil {
+		return "", "", false
+	}
+	return match[1], strings.TrimSpace(match[2]), true
+}
+
+// processJiraComment ...
+// Comments on the issue on behalf of whoever asked, and says so in the thread
+// of their message
+func processJiraComment(ctx context.Context, team *slackTeam, slackEvent slackRtmEvent) {
+	jiraIssue, comment, ok := getJiraComment(slackEvent)
+	if !ok {
+		return
+	}
+	reply := slackMessage{Channel: slackEvent.Channel, ThreadTs: slackEvent.ThreadTs}
+	if len(reply.ThreadTs) == 0 {
+		reply.ThreadTs = slackEvent.Ts
+	}
+	var created jiraCommentResp
+	payload := map[string]string{"body": jiraSignedText(team, slackEvent, comment)}
+	if err := jiraCall(ctx, team, "POST", fmt.Sprintf("issue/%s/comment", jiraIssue), payload, &created); err != nil {
+		reply.Text = fmt.Sprintf("Error commenting on jira issue [%s]: %s :rage:", jiraIssue, err)
+	} else {
+		commentUrl := fmt.Sprintf("%s/browse/%s?focusedCommentId=%s#comment-%s", team.config.JiraUrl, jiraIssue, created.Id, created.Id)
+		reply.Text = fmt.Sprintf(":speech_balloon: <%s|Comment added> to %s", commentUrl, jiraIssue)
+	}
+	if handlerCancelled(ctx, team, "jira comment reply") {
+		return
+	}
+	team.poster.sendSlackMessage(reply)
+}
+
+// jiraSignedText ...
+// text in jira's wiki markup, signed by its author with a link back to the
+// message it came from
+func jiraSignedText(team *slackTeam, slackEvent slackRtmEvent, text string) string {
+	author := slackEvent.User
+	if user, ok := team.directory.user(slackEvent.User); ok {
+		author = user.fullName()
+	}
+	signature := fmt.Sprintf("_— %s, via Slack_", author)
+	if permalink, err := team.web.getPermalink(slackEvent.Channel, slackEvent.Ts); err != nil {
+		log.Printf("Can't link jira back to slack message in team [%s]: %s", team.name(), err)
+	} else {
+		signature = fmt.Sprintf("_— %s, via [Slack|%s]_", author, permalink)
+	}
+	if len(strings.TrimSpace(text)) == 0 {
+		return signature
+	}
+	return slackToJiraWiki(team, text) + "\n\n" + signature
+}
+
+// slackToJiraWiki ...
+// Converts a message's mrkdwn to jira's wiki markup, naming the people and
+// channels it mentions. *bold* and _italic_ mean the same to both.
+func slackToJiraWiki(team *slackTeam, text string) string {
+	text = slackCodeBlockRe.ReplaceAllString(text, "{noformat}\n$1\n{noformat}")
+	text = slackCodeRe.ReplaceAllString(text, "{{$1}}")
+	text = slackStrikeRe.ReplaceAllString(text, "$1-$2-")
+	text = slackMarkupRe.ReplaceAllStringFunc(text, func(markup string) string {
+		parts := slackMarkupRe.FindStringSubmatch(markup)
+		sigil, target, label := parts[1], parts[2], parts[3]
+		switch sigil {
+		case "@":
+			if user, ok := team.directory.user(target); ok {
+				return "@" + user.fullName()
+			}
+			if len(label) > 0 {
+				return "@" + label
+			}
+			return "@" + target
+		case "#":
+			if len(label) == 0 {
+				if channel, ok := team.directory.channel(target); ok {
+					label = channel.Name
+				} else {
+					label = target
+				}
+			}
+			return "#" + label
+		case "!":
+			// <!here>, <!channel>, <!subteam^S1|@team>
+			if len(label) > 0 {
+				return label
+			}
+			return "@" + target
+		}
+		if len(label) > 0 {
+			return fmt.Sprintf("[%s|%s]", label, target)
+		}
+		return target
+	})
+	return slackUnescaper.Replace(text)
+}
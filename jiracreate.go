@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// messages starting jira create are meant for processJiraCreate
+	jiraCreateRe = regexp.MustCompile(`(?i)^\s*jira\s+create\b`)
+	// jira create PROJ <issue type> <summary>, then the description on the lines after
+	jiraCreateArgsRe = regexp.MustCompile(`(?is)^\s*jira\s+create[ \t]+(\S+)[ \t]+([^\n]*?)\s*(?:\n(.*))?$`)
+)
+
+const jiraCreateUsage = "Usage: `jira create PROJ <issue type> <summary>`, with an optional description on the lines after it"
+
+// jiraIssueType is a kind of issue a project lets us create
+type jiraIssueType struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Subtask bool   `json:"subtask"`
+}
+
+// A page of issue/createmeta/{project}/issuetypes, which Jira Data Center
+// (8.4 on) calls values and Jira Cloud calls issueTypes
+type jiraIssueTypesResp struct {
+	Values     []jiraIssueType `json:"values"`
+	IssueTypes []jiraIssueType `json:"issueTypes"`
+	Total      int             `json:"total"`
+	IsLast     bool            `json:"isLast"`
+}
+
+// The bits of issue/createmeta?projectKeys= we validate against; older Jira
+// only has this, and Jira 9 removed it
+type jiraCreateMetaResp struct {
+	Projects []struct {
+		Key        string          `json:"key"`
+		IssueTypes []jiraIssueType `json:"issuetypes"`
+	} `json:"projects"`
+}
+
+type jiraCreateResp struct {
+	Key string `json:"key"`
+}
+
+// jiraCreateRequest is a parsed jira create command
+type jiraCreateRequest struct {
+	project string
+	// the issue type and summary, which only createmeta can tell apart
+	typeAndSummary string
+	description    string
+}
+
+// getJiraCreateRequest ...
+func getJiraCreateRequest(text string) (jiraCreateRequest, error) {
+	match := jiraCreateArgsRe.FindStringSubmatch(text)
+	if match == nil || len(match[2]) == 0 {
+		return jiraCreateRequest{}, errors.New(jiraCreateUsage)
+	}
+	return jiraCreateRequest{
+		project:        strings.ToUpper(match[1]),
+		typeAndSummary: match[2],
+		description:    strings.TrimSpace(match[3]),
+	}, nil
+}
+
+// processJiraCreate ...
+// Creates an issue for whoever asked, and answers with its key and link
+func processJiraCreate(ctx context.Context, team *slackTeam, slackEvent slackRtmEvent) {
+	var reply slackMessage
+	key, summary, err := createJiraIssue(ctx, team, slackEvent)
+	if err != nil {
+		reply.Text = fmt.Sprintf("Can't create that jira issue: %s :rage:", err)
+	} else {
+		// summary came from slack, so is escaped already
+		reply.Text = fmt.Sprintf(":white_check_mark: Created <%s/browse/%s|%s>: %s", team.config.JiraUrl, key, key, summary)
+	}
+	if handlerCancelled(ctx, team, "jira create reply") {
+		return
+	}
+	team.poster.sendSlackMessage(team.replyTo(slackEvent, reply))
+}
+
+// createJiraIssue ...
+// Validates the request against createmeta before creating the issue, so
+// mistakes get an explanation rather than an http code
+func createJiraIssue(ctx context.Context, team *slackTeam, slackEvent slackRtmEvent) (string, string, error) {
+	request, err := getJiraCreateRequest(slackEvent.Text)
+	if err != nil {
+		return "", "", err
+	}
+	issueTypes, err := getJiraIssueTypes(ctx, team, request.project)
+	if err != nil {
+		return "", "", explainJiraCreateError(request.project, err)
+	}
+
+	// the longest issue type the request starts with, so "New Feature" wins over "New"
+	issueTypeId, issueType, summary := "", "", ""
+	var available []string
+	for _, candidate := range issueTypes {
+		if candidate.Subtask {
+			// these need a parent, which we've no way of asking for
+			continue
+		}
+		available = append(available, candidate.Name)
+		prefix := strings.ToLower(candidate.Name)
+		lower := strings.ToLower(request.typeAndSummary)
+		if len(candidate.Name) > len(issueType) && (lower == prefix || strings.HasPrefix(lower, prefix+" ")) {
+			issueTypeId, issueType = candidate.Id, candidate.Name
+			summary = strings.TrimSpace(request.typeAndSummary[len(candidate.Name):])
+		}
+	}
+	if len(issueTypeId) == 0 {
+		sort.Strings(available)
+		return "", "", fmt.Errorf("%s has no issue type at the start of [%s]; try one of: %s",
+			request.project, request.typeAndSummary, strings.Join(available, ", "))
+	}
+	if len(summary) == 0 {
+		return "", "", fmt.Errorf("the %s needs a summary. %s", issueType, jiraCreateUsage)
+	}
+
+	fields := map[string]interface{}{
+		"project":     map[string]string{"key": request.project},
+		"issuetype":   map[string]string{"id": issueTypeId},
+		"summary":     slackToJiraWiki(team, summary),
+		"description": jiraSignedText(team, slackEvent, request.description),
+	}
+	var created jiraCreateResp
+	if err := jiraCall(ctx, team, "POST", "issue", map[string]interface{}{"fields": fields}, &created); err != nil {
+		return "", "", explainJiraCreateError(request.project, err)
+	}
+	return created.Key, summary, nil
+}
+
+// errNoJiraProject is what getJiraIssueTypes returns for projects we can't see
+var errNoJiraProject = errors.New("no such project")
+
+// getJiraIssueTypes ...
+// The issue types project allows, from issue/createmeta/{project}/issuetypes
+// where jira has it, or the older issue/createmeta?projectKeys= where it doesn't
+func getJiraIssueTypes(ctx context.Context, team *slackTeam, project string) ([]jiraIssueType, error) {
+	var issueTypes []jiraIssueType
+	for {
+		var page jiraIssueTypesResp
+		path := fmt.Sprintf("issue/createmeta/%s/issuetypes?startAt=%d", url.PathEscape(project), len(issueTypes))
+		err := jiraCall(ctx, team, "GET", path, nil, &page)
+		var httpErr *jiraHttpError
+		if errors.As(err, &httpErr) && httpErr.Code == 404 && len(issueTypes) == 0 {
+			// an unknown project, or a jira from before 8.4
+			return getJiraIssueTypesLegacy(ctx, team, project)
+		} else if err != nil {
+			return nil, err
+		}
+		found := append(page.Values, page.IssueTypes...)
+		issueTypes = append(issueTypes, found...)
+		if page.IsLast || len(found) == 0 || (page.Total > 0 && len(issueTypes) >= page.Total) {
+			return issueTypes, nil
+		}
+	}
+}
+
+// getJiraIssueTypesLegacy ...
+func getJiraIssueTypesLegacy(ctx context.Context, team *slackTeam, project string) ([]jiraIssueType, error) {
+	var meta jiraCreateMetaResp
+	path := "issue/createmeta?" + url.Values{"projectKeys": {project}}.Encode()
+	err := jiraCall(ctx, team, "GET", path, nil, &meta)
+	var httpErr *jiraHttpError
+	if errors.As(err, &httpErr) && httpErr.Code == 404 {
+		// a jira without this endpoint, whose newer one didn't know project either
+		return nil, errNoJiraProject
+	} else if err != nil {
+		return nil, err
+	}
+	if len(meta.Projects) == 0 {
+		return nil, errNoJiraProject
+	}
+	return meta.Projects[0].IssueTypes, nil
+}
+
+// explainJiraCreateError ...
+// Turns what jira said into something the person asking can act on
+func explainJiraCreateError(project string, err error) error {
+	if err == errNoJiraProject {
+		return fmt.Errorf("there's no project [%s], or I'm not allowed to create issues in it", project)
+	}
+	var httpErr *jiraHttpError
+	if !errors.As(err, &httpErr) {
+		return fmt.Errorf("trouble talking to jira: %s", err)
+	}
+	reasons := strings.Join(httpErr.Reasons, "; ")
+	switch {
+	case httpErr.Code == 401:
+		return errors.New("jira didn't accept my credentials; ask whoever runs me to check JiraUser and JiraPass")
+	case httpErr.Code == 403:
+		return fmt.Errorf("I'm not allowed to create issues in %s", project)
+	case httpErr.Code == 400 && len(reasons) > 0:
+		return fmt.Errorf("jira refused the issue: %s", reasons)
+	case len(reasons) > 0:
+		return fmt.Errorf("jira said: %s", reasons)
+	}
+	return fmt.Errorf("jira failed with http code %d; try again later", httpErr.Code)
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jiraDescription is an issue's description: wiki markup from the v2 API, or an
+// Atlassian Document Format (ADF) document from Jira Cloud's v3 API
+type jiraDescription struct {
+	Wiki string
+	Doc  *adfNode
+}
+
+// adfNode is any node of an ADF document; marks share the shape
+type adfNode struct {
+	Type    string                 `json:"type"`
+	Text    string                 `json:"text,omitempty"`
+	Attrs   map[string]interface{} `json:"attrs,omitempty"`
+	Marks   []adfNode              `json:"marks,omitempty"`
+	Content []adfNode              `json:"content,omitempty"`
+}
+
+// Slack has no horizontal rule; this is what ---- turns into
+const slackRule = "──────────"
+
+var (
+	// {code}, {code:java}, {noformat} and friends, which open and close preformatted blocks
+	jiraPreformattedRe = regexp.MustCompile(`\{(code|noformat)(?::[^}]*)?\}`)
+	jiraHeadingRe      = regexp.MustCompile(`^h[1-6]\.\s+(.*)$`)
+	jiraBlockquoteRe   = regexp.MustCompile(`^bq\.\s+(.*)$`)
+	// "* item", "## item", "*# item" and "- item"; a bare marker with no space is bold text
+	jiraListRe = regexp.MustCompile(`^([*#]+|-)\s+(.*)$`)
+	jiraRuleRe = regexp.MustCompile(`^-{4,}$`)
+
+	jiraLinkRe     = regexp.MustCompile(`\[([^\[\]|]*)\|([^\[\]|]+)(?:\|[^\[\]]*)?\]`)
+	jiraBareLinkRe = regexp.MustCompile(`\[((?:https?|ftp|mailto|file):[^\[\]|]+)\]`)
+	jiraUserLinkRe = regexp.MustCompile(`\[~([^\[\]]+)\]`)
+	jiraMonoRe     = regexp.MustCompile(`\{\{(.+?)\}\}`)
+	jiraColorRe    = regexp.MustCompile(`\{color(?::[^}]*)?\}`)
+	jiraImageRe    = regexp.MustCompile(`!([^!\s|]+)(?:\|[^!]*)?!`)
+	jiraCiteRe     = regexp.MustCompile(`\?\?(.+?)\?\?`)
+	// effects wrapped in a single character only count at word boundaries, so
+	// that hyphenated-words and a+b+c are left alone
+	jiraStrikeRe    = jiraEffectRe("-")
+	jiraUnderlineRe = jiraEffectRe(`\+`)
+	// except for sub- and superscripts, which hug what they follow (H~2~O, x^2^)
+	jiraSubscriptRe = regexp.MustCompile(`~([^\s~]+)~`)
+	jiraSuperRe     = regexp.MustCompile(`\^([^\s^]+)\^`)
+)
+
+// The emoticons jira draws as icons, in slack's terms
+var jiraEmoticons = strings.NewReplacer(
+	"(/)", ":white_check_mark:",
+	"(x)", ":x:",
+	"(!)", ":warning:",
+	"(i)", ":information_source:",
+	"(?)", ":question:",
+	"(y)", ":thumbsup:",
+	"(n)", ":thumbsdown:",
+	"(on)", ":bulb:",
+	"(*)", ":star:",
+)
+
+// Slack treats these as control characters anywhere in a message
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// jiraEffectRe ...
+func jiraEffectRe(marker string) *regexp.Regexp {
+	return regexp.MustCompile(`(^|[\s(])` + marker + `([^\s` + marker + `](?:[^` + marker + `\n]*[^\s` + marker + `])?)` + marker + `($|[\s).,;:!?])`)
+}
+
+// UnmarshalJSON ...
+func (d *jiraDescription) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		d.Doc = &adfNode{}
+		return json.Unmarshal(data, d.Doc)
+	}
+	return json.Unmarshal(data, &d.Wiki)
+}
+
+// MarshalJSON ...
+func (d jiraDescription) MarshalJSON() ([]byte, error) {
+	if d.Doc != nil {
+		return json.Marshal(d.Doc)
+	}
+	return json.Marshal(d.Wiki)
+}
+
+// mrkdwn ...
+func (d jiraDescription) mrkdwn() string {
+	if d.Doc != nil {
+		return adfToMrkdwn(*d.Doc)
+	}
+	return jiraWikiToMrkdwn(d.Wiki)
+}
+
+// jiraWikiToMrkdwn ...
+// Converts jira wiki markup to slack's mrkdwn. Preformatted blocks are
+// carried over as they are; everything else is converted a line at a time.
+func jiraWikiToMrkdwn(wiki string) string {
+	wiki = strings.Replace(wiki, "\r\n", "\n", -1)
+	var blocks []string
+	addText := func(text string) {
+		if text = strings.Trim(jiraWikiTextToMrkdwn(text), "\n"); len(text) > 0 {
+			blocks = append(blocks, text)
+		}
+	}
+	for len(wiki) > 0 {
+		loc := jiraPreformattedRe.FindStringSubmatchIndex(wiki)
+		if loc == nil {
+			addText(wiki)
+			break
+		}
+		addText(wiki[:loc[0]])
+		closing := "{" + wiki[loc[2]:loc[3]] + "}"
+		rest := wiki[loc[1]:]
+		end := strings.Index(rest, closing)
+		if end < 0 {
+			// unterminated, as jira itself renders it: to the end
+			end, wiki = len(rest), ""
+		} else {
+			wiki = rest[end+len(closing):]
+		}
+		blocks = append(blocks, "```\n"+slackEscaper.Replace(strings.Trim(rest[:end], "\n"))+"\n```")
+	}
+	return strings.Join(blocks, "\n")
+}
+
+// jiraWikiTextToMrkdwn ...
+// Converts wiki markup without preformatted blocks in it
+func jiraWikiTextToMrkdwn(text string) string {
+	var lines []string
+	quoted := false
+	// the number of the next item of each ordered list we're in, by depth
+	var numbers []int
+	for _, line := range strings.Split(text, "\n") {
+		// {quote} toggles quoting and may open and close within a line
+		pieces := strings.Split(line, "{quote}")
+		for i, piece := range pieces {
+			if i > 0 {
+				quoted = !quoted
+			}
+			if len(pieces) > 1 && len(strings.TrimSpace(piece)) == 0 {
+				continue
+			}
+			converted := jiraWikiLine(strings.TrimSpace(piece), &numbers)
+			if quoted {
+				converted = "> " + converted
+			}
+			lines = append(lines, converted)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// jiraWikiLine ...
+// Converts one line, keeping track of ordered list numbering across lines
+func jiraWikiLine(line string, numbers *[]int) string {
+	match := jiraListRe.FindStringSubmatch(line)
+	if match == nil || jiraRuleRe.MatchString(line) {
+		*numbers = nil
+	}
+	switch {
+	case jiraRuleRe.MatchString(line):
+		return slackRule
+	case match != nil:
+		depth := len(match[1])
+		for len(*numbers) < depth {
+			*numbers = append(*numbers, 1)
+		}
+		// a shallower item ends any deeper lists
+		*numbers = (*numbers)[:depth]
+		marker := "• "
+		if strings.HasSuffix(match[1], "#") {
+			marker = fmt.Sprintf("%d. ", (*numbers)[depth-1])
+			(*numbers)[depth-1]++
+		}
+		return strings.Repeat("    ", depth-1) + marker + jiraWikiInline(match[2])
+	}
+	if heading := jiraHeadingRe.FindStringSubmatch(line); heading != nil {
+		return slackEmphasis("*", jiraWikiInline(heading[1]))
+	}
+	if quote := jiraBlockquoteRe.FindStringSubmatch(line); quote != nil {
+		return "> " + jiraWikiInline(quote[1])
+	}
+	if strings.HasPrefix(line, "||") {
+		cells := splitJiraTableRow(strings.Replace(line, "||", "|", -1))
+		for i, cell := range cells {
+			cells[i] = slackEmphasis("*", jiraWikiInline(cell))
+		}
+		return strings.Join(cells, " | ")
+	}
+	if strings.HasPrefix(line, "|") {
+		cells := splitJiraTableRow(line)
+		for i, cell := range cells {
+			cells[i] = jiraWikiInline(cell)
+		}
+		return strings.TrimSpace(strings.Join(cells, " | "))
+	}
+	return jiraWikiInline(line)
+}
+
+// splitJiraTableRow ...
+// The cells of a |-delimited row; bars inside links don't count
+func splitJiraTableRow(row string) []string {
+	var cells []string
+	var cell strings.Builder
+	depth := 0
+	for _, r := range row {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		case '|':
+			if depth == 0 {
+				cells = append(cells, strings.TrimSpace(cell.String()))
+				cell.Reset()
+				continue
+			}
+		}
+		cell.WriteRune(r)
+	}
+	cells = append(cells, strings.TrimSpace(cell.String()))
+	// the bars at either end of the row leave nothing outside them
+	if len(cells) > 0 && len(cells[0]) == 0 {
+		cells = cells[1:]
+	}
+	if len(cells) > 0 && len(cells[len(cells)-1]) == 0 {
+		cells = cells[:len(cells)-1]
+	}
+	return cells
+}
+
+// jiraWikiInline ...
+// Converts the text effects, links and emoticons within a line
+func jiraWikiInline(text string) string {
+	text = slackEscaper.Replace(text)
+	text = jiraColorRe.ReplaceAllString(text, "")
+	text = jiraMonoRe.ReplaceAllString(text, "`$1`")
+	text = jiraUserLinkRe.ReplaceAllString(text, "@$1")
+	text = jiraLinkRe.ReplaceAllStringFunc(text, func(link string) string {
+		parts := jiraLinkRe.FindStringSubmatch(link)
+		if len(strings.TrimSpace(parts[1])) == 0 {
+			return "<" + parts[2] + ">"
+		}
+		return "<" + parts[2] + "|" + parts[1] + ">"
+	})
+	text = jiraBareLinkRe.ReplaceAllString(text, "<$1>")
+	text = jiraImageRe.ReplaceAllString(text, ":frame_with_picture: $1")
+	text = jiraCiteRe.ReplaceAllString(text, "_${1}_")
+	// subscript first, since strikethrough turns into slack's ~
+	text = jiraSubscriptRe.ReplaceAllString(text, "$1")
+	text = jiraSuperRe.ReplaceAllString(text, "$1")
+	text = jiraUnderlineRe.ReplaceAllString(text, "$1$2$3")
+	text = jiraStrikeRe.ReplaceAllString(text, "$1~$2~$3")
+	text = strings.Replace(text, `\\`, "\n", -1)
+	return jiraEmoticons.Replace(text)
+}
+
+// slackEmphasis ...
+// Wraps text in marker (*, _ or ~), keeping surrounding spaces outside it as
+// slack only recognizes emphasis that hugs its text
+func slackEmphasis(marker string, text string) string {
+	trimmed := strings.TrimSpace(text)
+	if len(trimmed) == 0 {
+		return text
+	}
+	start := strings.Index(text, trimmed)
+	return text[:start] + marker + trimmed + marker + text[start+len(trimmed):]
+}
+
+// adfToMrkdwn ...
+// Converts an ADF document to slack's mrkdwn
+func adfToMrkdwn(doc adfNode) string {
+	return adfBlocks(doc.Content, "\n\n")
+}
+
+// adfBlocks ...
+func adfBlocks(nodes []adfNode, separator string) string {
+	var blocks []string
+	for _, node := range nodes {
+		if block := adfBlock(node); len(block) > 0 {
+			blocks = append(blocks, block)
+		}
+	}
+	return strings.Join(blocks, separator)
+}
+
+// adfBlock ...
+func adfBlock(node adfNode) string {
+	switch node.Type {
+	case "paragraph":
+		return adfInline(node.Content)
+	case "heading":
+		return slackEmphasis("*", slackEscaper.Replace(adfPlainText(node.Content)))
+	case "bulletList", "orderedList":
+		return adfList(node, 0)
+	case "codeBlock":
+		return "```\n" + slackEscaper.Replace(adfPlainText(node.Content)) + "\n```"
+	case "blockquote", "panel":
+		lines := strings.Split(adfBlocks(node.Content, "\n"), "\n")
+		for i, line := range lines {
+			lines[i] = "> " + line
+		}
+		return strings.Join(lines, "\n")
+	case "rule":
+		return slackRule
+	case "table":
+		var rows []string
+		for _, row := range node.Content {
+			var cells []string
+			for _, cell := range row.Content {
+				text := adfBlocks(cell.Content, " ")
+				if cell.Type == "tableHeader" {
+					text = slackEmphasis("*", slackEscaper.Replace(adfPlainText(cell.Content)))
+				}
+				cells = append(cells, text)
+			}
+			rows = append(rows, strings.Join(cells, " | "))
+		}
+		return strings.Join(rows, "\n")
+	case "mediaSingle", "mediaGroup", "media":
+		// attachments; there's nothing we can show of them
+		return ""
+	}
+	if len(node.Content) > 0 {
+		return adfBlocks(node.Content, "\n\n")
+	}
+	return adfInline([]adfNode{node})
+}
+
+// adfList ...
+func adfList(list adfNode, depth int) string {
+	number := 1
+	if order, err := strconv.Atoi(list.attr("order")); err == nil {
+		number = order
+	}
+	indent := strings.Repeat("    ", depth)
+	var lines []string
+	for _, item := range list.Content {
+		marker := "• "
+		if list.Type == "orderedList" {
+			marker = fmt.Sprintf("%d. ", number)
+			number++
+		}
+		for i, child := range item.Content {
+			if child.Type == "bulletList" || child.Type == "orderedList" {
+				lines = append(lines, adfList(child, depth+1))
+				continue
+			}
+			if i == 0 {
+				lines = append(lines, indent+marker+adfBlock(child))
+			} else {
+				lines = append(lines, indent+"    "+adfBlock(child))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// adfInline ...
+func adfInline(nodes []adfNode) string {
+	var text strings.Builder
+	for _, node := range nodes {
+		switch node.Type {
+		case "text":
+			text.WriteString(adfMarkedText(node))
+		case "hardBreak":
+			text.WriteString("\n")
+		case "mention":
+			mention := node.attr("text")
+			if !strings.HasPrefix(mention, "@") {
+				mention = "@" + mention
+			}
+			text.WriteString(slackEscaper.Replace(mention))
+		case "emoji":
+			text.WriteString(node.attr("shortName"))
+		case "inlineCard", "blockCard":
+			text.WriteString("<" + slackEscaper.Replace(node.attr("url")) + ">")
+		case "status":
+			text.WriteString("`" + slackEscaper.Replace(node.attr("text")) + "`")
+		case "date":
+			// milliseconds since the epoch
+			if millis, err := strconv.ParseInt(node.attr("timestamp"), 10, 64); err == nil {
+				text.WriteString(time.Unix(0, millis*int64(time.Millisecond)).UTC().Format("2006-01-02"))
+			}
+		default:
+			text.WriteString(adfInline(node.Content))
+		}
+	}
+	return text.String()
+}
+
+// adfMarkedText ...
+// A text node with its marks (bold, links etc) applied
+func adfMarkedText(node adfNode) string {
+	text := slackEscaper.Replace(node.Text)
+	link := ""
+	for _, mark := range node.Marks {
+		switch mark.Type {
+		case "strong":
+			text = slackEmphasis("*", text)
+		case "em":
+			text = slackEmphasis("_", text)
+		case "strike":
+			text = slackEmphasis("~", text)
+		case "code":
+			text = slackEmphasis("`", text)
+		case "link":
+			link = mark.attr("href")
+		}
+	}
+	if len(link) > 0 {
+		return "<" + slackEscaper.Replace(link) + "|" + text + ">"
+	}
+	return text
+}
+
+// adfPlainText ...
+// Just the text of nodes, ignoring their marks
+func adfPlainText(nodes []adfNode) string {
+	var text strings.Builder
+	for _, node := range nodes {
+		if node.Type == "hardBreak" {
+			text.WriteString("\n")
+		}
+		text.WriteString(node.Text)
+		text.WriteString(adfPlainText(node.Content))
+	}
+	return text.String()
+}
+
+// attr ...
+// An attribute of node as a string, whatever its JSON type
+func (node adfNode) attr(name string) string {
+	switch value := node.Attrs[name].(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Each description in testdata/jira is converted and compared with the
+// .mrkdwn file of the same name. Descriptions ending .wiki are wiki markup,
+// .adf.json are ADF documents.
+func TestJiraDescriptionCorpus(t *testing.T) {
+	sources, err := filepath.Glob(filepath.Join("testdata", "jira", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted := 0
+	for _, source := range sources {
+		var name string
+		var description jiraDescription
+		raw, err := ioutil.ReadFile(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case strings.HasSuffix(source, ".wiki"):
+			name = strings.TrimSuffix(source, ".wiki")
+			description.Wiki = string(raw)
+		case strings.HasSuffix(source, ".adf.json"):
+			name = strings.TrimSuffix(source, ".adf.json")
+			if err := json.Unmarshal(raw, &description); err != nil {
+				t.Fatalf("Error decoding %s: %s", source, err)
+			}
+		default:
+			continue
+		}
+		want, err := ioutil.ReadFile(name + ".mrkdwn")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := description.mrkdwn(); got != strings.TrimSuffix(string(want), "\n") {
+			t.Errorf("Converting %s\ngot:\n%s\nwant:\n%s", source, got, want)
+		}
+		converted++
+	}
+	if converted == 0 {
+		t.Error("Found no descriptions to convert")
+	}
+}
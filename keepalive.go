@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRtmPingInterval = 30 * time.Second
+	// Declare the connection dead once this many pings in a row go unanswered
+	rtmMissedPongsAllowed = 2
+)
+
+// Every message we send over RTM needs an id unique to the connection
+var lastRtmMessageId int64
+
+// nextRtmMessageId ...
+func nextRtmMessageId() int {
+	return int(atomic.AddInt64(&lastRtmMessageId, 1))
+}
+
+// rtmKeepalive tracks the pings we've sent and the pongs slack answered with
+type rtmKeepalive struct {
+	interval    time.Duration
+	outstanding map[int]time.Time
+	lastPong    time.Time
+}
+
+// pingInterval ...
+// How often we check slack is still there, over RTM or Socket Mode
+func pingInterval() time.Duration {
+	if config.RtmPingInterval > 0 {
+		return time.Duration(config.RtmPingInterval) * time.Second
+	}
+	return defaultRtmPingInterval
+}
+
+func newRtmKeepalive() *rtmKeepalive {
+	return &rtmKeepalive{
+		interval:    pingInterval(),
+		outstanding: map[int]time.Time{},
+		lastPong:    time.Now(),
+	}
+}
+
+// reset ...
+// Forgets everything about the previous connection
+func (k *rtmKeepalive) reset() {
+	k.outstanding = map[int]time.Time{}
+	k.lastPong = time.Now()
+}
+
+// dead ...
+// True once slack has gone rtmMissedPongsAllowed intervals without answering a ping
+func (k *rtmKeepalive) dead(now time.Time) bool {
+	return len(k.outstanding) > 0 && now.Sub(k.lastPong) > k.interval*rtmMissedPongsAllowed
+}
+
+// sendPing ...
+func (k *rtmKeepalive) sendPing(wsClient *websocketData) error {
+	id := nextRtmMessageId()
+	jPayload, err := json.Marshal(slackRtmEvent{Id: id, Type: "ping"})
+	if err != nil {
+		return fmt.Errorf("Error encoding ping payload: %s", err)
+	}
+	k.outstanding[id] = time.Now()
+	return wsClient.writeSocket(jPayload)
+}
+
+// pong ...
+// Records a pong, if it answers one of our pings
+func (k *rtmKeepalive) pong(replyTo int) {
+	sent, ok := k.outstanding[replyTo]
+	if !ok {
+		logDebug(fmt.Sprintf("Ignoring pong for unknown ping [%d]", replyTo))
+		return
+	}
+	logDebug(fmt.Sprintf("Got pong for ping [%d] after %s", replyTo, time.Since(sent)))
+	// Anything sent before this ping has been superseded
+	for id, ts := range k.outstanding {
+		if !ts.After(sent) {
+			delete(k.outstanding, id)
+		}
+	}
+	k.lastPong = time.Now()
+}
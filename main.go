@@ -2,23 +2,203 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 type configData struct {
-	SlackApiUrl         string
-	SlackApiToken       string
-	HttpTimeout         int
-	JiraUrl             string
-	JiraUser            string
-	JiraPass            string
+	// The workspace to connect to. With Teams set, these are instead the
+	// defaults for every entry there.
+	teamConfig
+	HttpTimeout      int
+	EventsListenAddr string
+	// Longest wait between reconnect attempts, in seconds
+	ReconnectMaxDelay int
+	// Exit after this many consecutive failed reconnect attempts; 0 retries forever
+	ReconnectGiveUpAttempts int
+	// Seconds between RTM pings; the connection is considered dead after two go unanswered
+	RtmPingInterval int
+	// Most outbound messages allowed to wait for their turn; more are dropped
+	OutboundQueueSize int
+	// Names of handlers (e.g. "dilbert", "jira") to leave switched off
+	DisabledHandlers []string
+	// Goroutines handling events, and how many events each may have waiting
+	EventWorkers   int
+	EventQueueSize int
+	// Seconds a handler may spend on one event before we stop waiting for it
+	HandlerTimeout int
+	// Seconds to let in-flight replies finish when asked to shut down
+	ShutdownTimeout int
+	// Every workspace to serve from this process
+	Teams []teamConfig
+}
+
+// teamConfig is everything specific to one slack workspace
+type teamConfig struct {
+	// Identifies the team in logs (and its dilbert records); required with Teams
+	Name          string
+	SlackApiUrl   string
+	SlackApiToken string
+	JiraUrl       string
+	JiraUser      string
+	JiraPass      string
+	// Project keys (e.g. "OPS") recognized without a "jira#" in front, in
+	// channels with BareJiraKeys set
+	JiraProjects        []string
 	SlackDilbertChannel string
+	// One of "rtm" (the default), "socketmode" or "events"
+	SlackTransport string
+	// App-level token (xapp-...), only needed for socketmode
+	SlackAppToken string
+	// Only needed for events
+	SlackSigningSecret string
+	// Bot IDs (or usernames) whose messages we handle; all other bots, and
+	// ourselves, are ignored
+	AllowedBots []string
+	// Per-channel behaviour, keyed by channel ID; "default" applies to the rest
+	Channels map[string]channelConfig
+}
+
+// channelConfig is how the bot behaves in a particular channel
+type channelConfig struct {
+	// "follow" (the default) replies in a thread only when asked from one,
+	// "always" starts a thread off the triggering message, "never" posts
+	// everything to the channel itself
+	ThreadReplies string
+	// Also send thread replies to the channel
+	BroadcastThreadReplies bool
+	// Answer bare issue keys (OPS-1423) from JiraProjects, not just jira#OPS-1423
+	BareJiraKeys bool
+}
+
+const (
+	threadRepliesFollow = "follow"
+	threadRepliesAlways = "always"
+	threadRepliesNever  = "never"
+)
+
+// teamConfigs ...
+// Every workspace to serve, with unset fields filled in from the top level
+func (c *configData) teamConfigs() []teamConfig {
+	if len(c.Teams) == 0 {
+		return []teamConfig{c.teamConfig}
+	}
+	var teams []teamConfig
+	for _, team := range c.Teams {
+		teams = append(teams, team.withDefaults(c.teamConfig))
+	}
+	return teams
+}
+
+// withDefaults ...
+func (c teamConfig) withDefaults(defaults teamConfig) teamConfig {
+	fill := func(field *string, fallback string) {
+		if len(*field) == 0 {
+			*field = fallback
+		}
+	}
+	fill(&c.SlackApiUrl, defaults.SlackApiUrl)
+	fill(&c.SlackApiToken, defaults.SlackApiToken)
+	fill(&c.JiraUrl, defaults.JiraUrl)
+	fill(&c.JiraUser, defaults.JiraUser)
+	fill(&c.JiraPass, defaults.JiraPass)
+	fill(&c.SlackDilbertChannel, defaults.SlackDilbertChannel)
+	fill(&c.SlackTransport, defaults.SlackTransport)
+	fill(&c.SlackAppToken, defaults.SlackAppToken)
+	fill(&c.SlackSigningSecret, defaults.SlackSigningSecret)
+	if c.AllowedBots == nil {
+		c.AllowedBots = defaults.AllowedBots
+	}
+	if c.JiraProjects == nil {
+		c.JiraProjects = defaults.JiraProjects
+	}
+	if c.Channels == nil {
+		c.Channels = defaults.Channels
+	}
+	return c
 }
 
 var config configData
 
+const (
+	transportRtm        = "rtm"
+	transportSocketMode = "socketmode"
+	transportEvents     = "events"
+)
+
 // main ...
 func main() {
+	rand.Seed(time.Now().UnixNano())
 	populateConfig()
-	logDebug(fmt.Sprintf("Starting up with Slack API url [%s] token [%s]", config.SlackApiUrl, config.SlackApiToken))
-	connectToSlack()
+	registerDefaultHandlers()
+
+	if replayFile := os.Getenv("databot_replay"); len(replayFile) > 0 {
+		replayRecording(replayFile)
+		return
+	}
+	startRecording()
+
+	var wg sync.WaitGroup
+	var teams, eventsTeams []*slackTeam
+	for _, teamConf := range config.teamConfigs() {
+		team := newSlackTeam(teamConf)
+		teams = append(teams, team)
+		logDebug(fmt.Sprintf("Starting up team [%s] with Slack API url [%s] token [%s]", team.name(), teamConf.SlackApiUrl, teamConf.SlackApiToken))
+		var run func(*slackTeam)
+		switch teamConf.SlackTransport {
+		case transportSocketMode:
+			run = connectToSlackSocketMode
+		case transportEvents:
+			// these all share one HTTP listener
+			eventsTeams = append(eventsTeams, team)
+			continue
+		default:
+			run = connectToSlack
+		}
+		wg.Add(1)
+		go func(team *slackTeam) {
+			defer wg.Done()
+			run(team)
+		}(team)
+	}
+	shutdownOnSignal(teams)
+	if len(eventsTeams) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveEventsApi(eventsTeams)
+		}()
+	}
+	wg.Wait()
+	recorder.close()
+	if allGaveUp(teams) {
+		log.Fatal(fmt.Sprintf("Gave up on every team; exiting (%s)", lastErrors(teams)))
+	}
+	log.Printf("Shut down cleanly")
+}
+
+// allGaveUp ...
+func allGaveUp(teams []*slackTeam) bool {
+	for _, team := range teams {
+		if state, _ := team.conn.get(); state != connStateGaveUp {
+			return false
+		}
+	}
+	return len(teams) > 0
+}
+
+// lastErrors ...
+// Each team's last connection error, for explaining why we're exiting
+func lastErrors(teams []*slackTeam) string {
+	var errs []string
+	for _, team := range teams {
+		if err, at := team.conn.getError(); err != nil {
+			errs = append(errs, fmt.Sprintf("team [%s] at %s: %s", team.name(), at.Format(time.RFC3339), err))
+		}
+	}
+	return strings.Join(errs, "; ")
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// Slack allows roughly one message per second per connection
+	outboundSendInterval     = time.Second
+	defaultOutboundQueueSize = 100
+)
+
+var errOutboundQueueFull = errors.New("outbound queue is full, message dropped")
+
+type outboundOp int
+
+const (
+	outboundPost outboundOp = iota
+	// post through the Web API even if the transport could carry it
+	outboundRichPost
+	outboundUpdate
+	outboundDelete
+)
+
+// slackPostResult is what became of a queued message; Channel and Ts identify
+// it in slack when delivery succeeded
+type slackPostResult struct {
+	Channel string
+	Ts      string
+	Err     error
+}
+
+type outboundMsg struct {
+	message slackMessage
+	op      outboundOp
+	done    chan slackPostResult
+}
+
+// outboundQueue serializes everything the bot says. Messages for one channel
+// go out in the order they were queued; channels take turns so one chatty
+// channel can't starve the others.
+type outboundQueue struct {
+	mu       sync.Mutex
+	channels map[string][]*outboundMsg
+	// channels with something queued, in the order they get their next turn
+	turns    []string
+	size     int
+	capacity int
+	dropped  int
+	// a message is off the queue but not yet delivered
+	sending bool
+	wake    chan struct{}
+	// closed whenever there's nothing queued or being sent
+	idle chan struct{}
+	// run, once the team stops, returns as soon as the queue is empty; should
+	// anything be queued after that, it's started again
+	stop    <-chan struct{}
+	running bool
+	// the transport's own way of posting plain (possibly threaded) text;
+	// returns the ts slack assigned
+	send func(msg slackMessage) (string, error)
+	web  *slackWebClient
+}
+
+func newOutboundQueue(send func(msg slackMessage) (string, error), web *slackWebClient, stop <-chan struct{}) *outboundQueue {
+	capacity := defaultOutboundQueueSize
+	if config.OutboundQueueSize > 0 {
+		capacity = config.OutboundQueueSize
+	}
+	idle := make(chan struct{})
+	close(idle)
+	q := &outboundQueue{
+		channels: map[string][]*outboundMsg{},
+		capacity: capacity,
+		wake:     make(chan struct{}, 1),
+		idle:     idle,
+		stop:     stop,
+		running:  true,
+		send:     send,
+		web:      web,
+	}
+	go q.run()
+	return q
+}
+
+// createSlackPost ...
+// Queues msg for channel. The returned channel yields the delivery result once
+// the message has been sent (or dropped); callers are free to ignore it.
+func (q *outboundQueue) createSlackPost(msg string, channel string) <-chan slackPostResult {
+	return q.enqueue(slackMessage{Channel: channel, Text: msg}, outboundPost)
+}
+
+// sendSlackMessage ...
+// Like createSlackPost, for messages which carry more than a channel and text
+// (e.g. a thread_ts). Goes over the transport when it can.
+func (q *outboundQueue) sendSlackMessage(msg slackMessage) <-chan slackPostResult {
+	return q.enqueue(msg, outboundPost)
+}
+
+// createRichSlackPost ...
+// Like createSlackPost, but always delivered by chat.postMessage
+func (q *outboundQueue) createRichSlackPost(msg slackMessage) <-chan slackPostResult {
+	return q.enqueue(msg, outboundRichPost)
+}
+
+// updateSlackMessage ...
+// Replaces the message identified by msg.Channel and msg.Ts (chat.update)
+func (q *outboundQueue) updateSlackMessage(msg slackMessage) <-chan slackPostResult {
+	return q.enqueue(msg, outboundUpdate)
+}
+
+// deleteSlackMessage ...
+func (q *outboundQueue) deleteSlackMessage(channel string, ts string) <-chan slackPostResult {
+	return q.enqueue(slackMessage{Channel: channel, Ts: ts}, outboundDelete)
+}
+
+// enqueue ...
+func (q *outboundQueue) enqueue(msg slackMessage, op outboundOp) <-chan slackPostResult {
+	done := make(chan slackPostResult, 1)
+	channel := msg.Channel
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size >= q.capacity {
+		q.dropped++
+		log.Printf("Dropping message for channel [%s]; %d queued, %d dropped so far", channel, q.size, q.dropped)
+		done <- slackPostResult{Channel: channel, Err: errOutboundQueueFull}
+		return done
+	}
+	if q.size == 0 && !q.sending {
+		q.idle = make(chan struct{})
+	}
+	if len(q.channels[channel]) == 0 {
+		q.turns = append(q.turns, channel)
+	}
+	q.channels[channel] = append(q.channels[channel], &outboundMsg{msg, op, done})
+	q.size++
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return done
+}
+
+// pop ...
+// Takes the next message off the queue, or nil when it's empty
+func (q *outboundQueue) pop() *outboundMsg {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.turns) == 0 {
+		return nil
+	}
+	channel := q.turns[0]
+	q.turns = q.turns[1:]
+	pending := q.channels[channel]
+	msg := pending[0]
+	if len(pending) > 1 {
+		q.channels[channel] = pending[1:]
+		q.turns = append(q.turns, channel)
+	} else {
+		delete(q.channels, channel)
+	}
+	q.size--
+	q.sending = true
+	return msg
+}
+
+// drain ...
+// Waits, until deadline, for the queue to empty and the last message to be
+// delivered. False if the deadline came first.
+func (q *outboundQueue) drain(deadline time.Time) bool {
+	q.mu.Lock()
+	idle := q.idle
+	q.mu.Unlock()
+	select {
+	case <-idle:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
+// run ...
+// Sends queued messages one at a time, at most one per outboundSendInterval,
+// until the team stops and there's nothing left to send
+func (q *outboundQueue) run() {
+	for {
+		msg := q.pop()
+		if msg == nil {
+			select {
+			case <-q.wake:
+			case <-q.stop:
+				if q.stopIfEmpty() {
+					return
+				}
+			}
+			continue
+		}
+		result := q.deliver(msg)
+		if result.Err != nil {
+			log.Printf("Failed posting to channel [%s]: %s", msg.message.Channel, result.Err)
+		}
+		msg.done <- result
+		q.mu.Lock()
+		q.sending = false
+		if q.size == 0 {
+			close(q.idle)
+		}
+		q.mu.Unlock()
+		time.Sleep(outboundSendInterval)
+	}
+}
+
+// stopIfEmpty ...
+// True, and no longer running, if nothing is queued
+func (q *outboundQueue) stopIfEmpty() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size > 0 {
+		return false
+	}
+	q.running = false
+	return true
+}
+
+// deliver ...
+func (q *outboundQueue) deliver(msg *outboundMsg) slackPostResult {
+	result := slackPostResult{Channel: msg.message.Channel, Ts: msg.message.Ts}
+	switch {
+	case msg.op == outboundUpdate:
+		_, result.Err = q.web.updateMessage(msg.message)
+	case msg.op == outboundDelete:
+		result.Err = q.web.deleteMessage(msg.message.Channel, msg.message.Ts)
+	case msg.op == outboundRichPost || needsWebApi(msg.message):
+		resp, err := q.web.postMessage(msg.message)
+		result.Ts, result.Err = resp.Ts, err
+		if len(resp.Channel) > 0 {
+			result.Channel = resp.Channel
+		}
+	default:
+		result.Ts, result.Err = q.send(msg.message)
+	}
+	return result
+}
+
+// needsWebApi ...
+// True for messages RTM can't carry
+func needsWebApi(msg slackMessage) bool {
+	return len(msg.Text) > rtmMaxTextLength || msg.ReplyBroadcast || len(msg.Attachments) > 0 || len(msg.Blocks) > 0
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// recordedFrame is one line of a recording: a raw frame slack sent one of our
+// teams, or who that team knew us as from then on
+type recordedFrame struct {
+	Time  time.Time       `json:"time"`
+	Team  string          `json:"team"`
+	Frame json.RawMessage `json:"frame,omitempty"`
+	Self  *recordedSelf   `json:"self,omitempty"`
+}
+
+type recordedSelf struct {
+	UserId string `json:"user_id"`
+	BotId  string `json:"bot_id,omitempty"`
+	TeamId string `json:"team_id"`
+}
+
+// frameRecorder appends everything slack sends us to a JSONL file, for
+// replaying later
+type frameRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// recorder is nil unless databot_record names a file to record to
+var recorder *frameRecorder
+
+// startRecording ...
+// Opens the file named by databot_record (if set) for recording
+func startRecording() {
+	recordFile := os.Getenv("databot_record")
+	if len(recordFile) == 0 {
+		return
+	}
+	file, err := os.OpenFile(recordFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Error opening [%s] to record to: %s", recordFile, err))
+	}
+	log.Printf("Recording slack frames to [%s]", recordFile)
+	recorder = &frameRecorder{file: file, enc: json.NewEncoder(file)}
+}
+
+// record ...
+func (r *frameRecorder) record(team *slackTeam, frame []byte) {
+	if r == nil {
+		return
+	}
+	rec := recordedFrame{Time: time.Now(), Team: team.name(), Frame: frame}
+	if !json.Valid(frame) {
+		// keep it anyway, as a string; replay will skip it
+		rec.Frame, _ = json.Marshal(string(frame))
+	}
+	r.write(rec)
+}
+
+// recordSelf ...
+// Recorded whenever we (re)connect, so replay can ignore our own messages
+func (r *frameRecorder) recordSelf(team *slackTeam) {
+	if r == nil {
+		return
+	}
+	team.self.mu.RLock()
+	self := &recordedSelf{UserId: team.self.userId, BotId: team.self.botId, TeamId: team.self.teamId}
+	team.self.mu.RUnlock()
+	r.write(recordedFrame{Time: time.Now(), Team: team.name(), Self: self})
+}
+
+// close ...
+func (r *frameRecorder) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.file.Close(); err != nil {
+		log.Printf("Error closing recording: %s", err)
+	}
+}
+
+// write ...
+func (r *frameRecorder) write(rec recordedFrame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(rec); err != nil {
+		log.Printf("Error recording frame: %s", err)
+	}
+}
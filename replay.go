@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Where replays print what the bot would have said
+var replayOutput io.Writer = os.Stdout
+
+// Handlers which would change things outside the bot if replayed: dilbert
+// marks today as posted, and the jira commands would create issues and
+// comments all over again
+var replayDisabledHandlers = []string{"dilbert", "jira-create", "jira-comment"}
+
+// replayPoster prints everything handlers try to say as JSON lines on
+// stdout, instead of saying it in slack
+type replayPoster struct {
+	mu     sync.Mutex
+	team   string
+	out    *json.Encoder
+	lastTs int
+}
+
+// replayedPost is one line of replay output
+type replayedPost struct {
+	Team    string       `json:"team"`
+	Op      string       `json:"op"`
+	Message slackMessage `json:"message"`
+}
+
+func newReplayPoster(team string) *replayPoster {
+	return &replayPoster{team: team, out: json.NewEncoder(replayOutput)}
+}
+
+// createSlackPost ...
+func (p *replayPoster) createSlackPost(msg string, channel string) <-chan slackPostResult {
+	return p.post("post", slackMessage{Channel: channel, Text: msg})
+}
+
+// sendSlackMessage ...
+func (p *replayPoster) sendSlackMessage(msg slackMessage) <-chan slackPostResult {
+	return p.post("post", msg)
+}
+
+// createRichSlackPost ...
+func (p *replayPoster) createRichSlackPost(msg slackMessage) <-chan slackPostResult {
+	return p.post("rich_post", msg)
+}
+
+// updateSlackMessage ...
+func (p *replayPoster) updateSlackMessage(msg slackMessage) <-chan slackPostResult {
+	return p.post("update", msg)
+}
+
+// deleteSlackMessage ...
+func (p *replayPoster) deleteSlackMessage(channel string, ts string) <-chan slackPostResult {
+	return p.post("delete", slackMessage{Channel: channel, Ts: ts})
+}
+
+// drain ...
+// Nothing is ever queued
+func (p *replayPoster) drain(deadline time.Time) bool {
+	return true
+}
+
+// post ...
+// Prints msg and reports it delivered; new messages get made up timestamps
+// so later edits and deletes can refer to them
+func (p *replayPoster) post(op string, msg slackMessage) <-chan slackPostResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if op == "post" || op == "rich_post" {
+		p.lastTs++
+		msg.Ts = fmt.Sprintf("replay.%06d", p.lastTs)
+	}
+	done := make(chan slackPostResult, 1)
+	err := p.out.Encode(replayedPost{Team: p.team, Op: op, Message: msg})
+	done <- slackPostResult{Channel: msg.Channel, Ts: msg.Ts, Err: err}
+	return done
+}
+
+// replayRecording ...
+// Feeds every frame recorded in replayFile through the handlers, as the RTM
+// loop would have, with whatever they post printed to stdout in the order the
+// frames were recorded
+func replayRecording(replayFile string) {
+	file, err := os.Open(replayFile)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Error opening [%s] to replay: %s", replayFile, err))
+	}
+	defer file.Close()
+
+	for _, name := range replayDisabledHandlers {
+		if handlers.isEnabled(name) {
+			handlers.setEnabled(name, false)
+			defer handlers.setEnabled(name, true)
+		}
+	}
+
+	teams := map[string]*slackTeam{}
+	teamNamed := func(name string) *slackTeam {
+		if team, ok := teams[name]; ok {
+			return team
+		}
+		teamConf := teamConfig{Name: name}
+		for _, candidate := range config.teamConfigs() {
+			if candidate.Name == name || (len(candidate.Name) == 0 && name == "default") {
+				teamConf = candidate
+			}
+		}
+		team := newSlackTeam(teamConf)
+		team.poster = newReplayPoster(name)
+		teams[name] = team
+		return team
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 2*wsMaxMessageBytes)
+	replayed := 0
+	for line := 1; scanner.Scan(); line++ {
+		var rec recordedFrame
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("Skipping line %d of [%s]: %s", line, replayFile, err)
+			continue
+		}
+		team := teamNamed(rec.Team)
+		if rec.Self != nil {
+			team.self.set(rec.Self.UserId, rec.Self.BotId, rec.Self.TeamId)
+			continue
+		}
+		var slackEvent slackRtmEvent
+		if err := json.Unmarshal(rec.Frame, &slackEvent); err != nil {
+			logDebug(fmt.Sprintf("Not replaying line %d: [%s]", line, rec.Frame))
+			continue
+		}
+		if len(slackEvent.Type) == 0 || isRtmConnectionEvent(slackEvent.Type) {
+			continue
+		}
+		// one at a time, unlike live, so the output comes out in the same
+		// order on every replay
+		handlers.dispatch(team, slackEvent)
+		replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(fmt.Sprintf("Error reading [%s]: %s", replayFile, err))
+	}
+	for _, team := range teams {
+		if !team.finishWork(time.Now().Add(shutdownTimeout())) {
+			log.Printf("Gave up waiting for handlers in team [%s]", team.name())
+		}
+	}
+	log.Printf("Replayed %d events from [%s]", replayed, replayFile)
+}
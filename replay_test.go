@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// replayFrames ...
+// Writes frames to a recording from the default team, pointed at fs, and
+// replays it, returning what was printed
+func replayFrames(t *testing.T, fs *fakeSlack, frames ...string) string {
+	t.Helper()
+	savedConfig, savedOutput := config.teamConfig, replayOutput
+	defer func() {
+		config.teamConfig, replayOutput = savedConfig, savedOutput
+	}()
+	config.teamConfig = teamConfig{SlackApiUrl: fs.url(), SlackApiToken: "xoxb-test", JiraUrl: fs.url()}
+	var out bytes.Buffer
+	replayOutput = &out
+
+	var recording bytes.Buffer
+	enc := json.NewEncoder(&recording)
+	enc.Encode(recordedFrame{Time: time.Now(), Team: "default", Self: &recordedSelf{UserId: "UBOT", TeamId: "T1"}})
+	for _, frame := range frames {
+		enc.Encode(recordedFrame{Time: time.Now(), Team: "default", Frame: json.RawMessage(frame)})
+	}
+	replayFile := filepath.Join(t.TempDir(), "recording.jsonl")
+	if err := ioutil.WriteFile(replayFile, recording.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	replayRecording(replayFile)
+	return out.String()
+}
+
+func TestReplayDoesNotWriteToJira(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-1", "Exists")
+	out := replayFrames(t, fs,
+		`{"type":"message","channel":"C1","user":"U1","text":"jira create ABC Bug Broken again","ts":"1500000001.000001"}`,
+		`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-1.comment once only","ts":"1500000001.000002"}`)
+	if len(out) > 0 {
+		t.Errorf("Expected nothing to be said, got [%s]", out)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.jiraPosts > 0 {
+		t.Errorf("Expected nothing to be posted to jira, got %d POSTs", fs.jiraPosts)
+	}
+	for _, name := range []string{"jira-create", "jira-comment"} {
+		if !handlers.isEnabled(name) {
+			t.Errorf("Expected %s to be enabled again after the replay", name)
+		}
+	}
+}
+
+func TestReplayAnswersInRecordedOrder(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-1", "Slow")
+	fs.addIssue("ABC-2", "Fast")
+	release := fs.holdIssue("ABC-1")
+	go func() {
+		fs.awaitJiraRequest("ABC-1")
+		time.Sleep(200 * time.Millisecond)
+		release()
+	}()
+	out := replayFrames(t, fs,
+		`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-1","ts":"1500000001.000001"}`,
+		`{"type":"message","channel":"C2","user":"U1","text":"jira#ABC-2","ts":"1500000001.000002"}`)
+	var titles []string
+	dec := json.NewDecoder(bytes.NewBufferString(out))
+	for dec.More() {
+		var post replayedPost
+		if err := dec.Decode(&post); err != nil {
+			t.Fatalf("Replay printed something other than JSON lines: %s", err)
+		}
+		if len(post.Message.Attachments) > 0 {
+			titles = append(titles, post.Message.Attachments[0].Title)
+		}
+	}
+	if fmt.Sprint(titles) != "[ABC-1: Slow ABC-2: Fast]" {
+		t.Errorf("Expected the cards in the order they were asked for, got %q", titles)
+	}
+}
+
+func TestRecordingReplaysAsItHappened(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-1", "Recorded")
+	recordFile := filepath.Join(t.TempDir(), "recording.jsonl")
+	file, err := os.Create(recordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = &frameRecorder{file: file, enc: json.NewEncoder(file)}
+	defer func() { recorder = nil }()
+
+	team := fs.startBot(teamConfig{})
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-1","ts":"1500000001.000001"}`)
+	fs.awaitPost()
+	// our own messages are recorded too, but mustn't be answered on replay
+	fs.send(`{"type":"message","channel":"C1","user":"UBOT","text":"jira#ABC-1 again","ts":"1500000001.000002"}`)
+	fs.send(`{"type":"message","subtype":"message_deleted","channel":"C1","deleted_ts":"1500000001.000001","ts":"1500000001.000003"}`)
+	if post := fs.awaitPost(); post.Method != "chat.delete" {
+		t.Fatalf("Expected the reply to be deleted live, got [%s]", post.Method)
+	}
+	team.shutdown()
+	fs.awaitStopped()
+	recorder.close()
+	recorder = nil
+
+	savedConfig, savedOutput := config.teamConfig, replayOutput
+	defer func() {
+		config.teamConfig, replayOutput = savedConfig, savedOutput
+	}()
+	config.teamConfig = teamConfig{Name: team.name(), SlackApiUrl: fs.url(), SlackApiToken: "xoxb-test", JiraUrl: fs.url()}
+	var out bytes.Buffer
+	replayOutput = &out
+	replayRecording(recordFile)
+
+	var replayed []replayedPost
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var post replayedPost
+		if err := dec.Decode(&post); err != nil {
+			t.Fatalf("Replay printed something other than JSON lines: %s", err)
+		}
+		replayed = append(replayed, post)
+	}
+	if len(replayed) != 2 {
+		// and nothing for our own message
+		t.Fatalf("Expected a post and a delete, got %+v", replayed)
+	}
+	post, deleted := replayed[0], replayed[1]
+	if post.Team != team.name() || post.Op != "rich_post" || post.Message.Channel != "C1" ||
+		len(post.Message.Attachments) != 1 || post.Message.Attachments[0].Title != "ABC-1: Recorded" {
+		t.Errorf("Unexpected replayed post %+v", post)
+	}
+	if deleted.Op != "delete" || deleted.Message.Channel != "C1" || deleted.Message.Ts != post.Message.Ts {
+		t.Errorf("Expected %s to be deleted, got %+v", post.Message.Ts, deleted)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// How long slack gets to answer a message with a reply_to before we retry it
+	rtmAckTimeout   = 10 * time.Second
+	rtmSendAttempts = 3
+)
+
+// sendRtmMessage ...
+// Given a message, post it to slack over the websocket
+func (wsClient *websocketData) sendRtmMessage(id int, msg slackMessage) error {
+	payload := slackRtmEvent{
+		Id:       id,
+		Type:     "message",
+		Channel:  msg.Channel,
+		Text:     msg.Text,
+		ThreadTs: msg.ThreadTs,
+	}
+	jPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Error encoding slackRtmEvent payload: %s", err)
+	}
+	return wsClient.writeSocket(jPayload)
+}
+
+// rtmSession owns the RTM connection across reconnects, so the outbound
+// queue always writes to whichever websocket is current, and keeps track of
+// which of our messages slack has yet to acknowledge.
+type rtmSession struct {
+	mu       sync.Mutex
+	wsClient websocketData
+	// closed when wsClient is torn down
+	lost chan struct{}
+	// closed once slack says hello on wsClient
+	ready chan struct{}
+	// where slack told us to resume, should this connection drop
+	reconnectUrl string
+	// message id => waiting sender
+	pending  map[int]chan slackRtmEvent
+	outbound *outboundQueue
+	team     *slackTeam
+	// only used from the RTM loop, which does all the connecting
+	backoff *connectionBackoff
+}
+
+func newRtmSession(team *slackTeam) *rtmSession {
+	session := &rtmSession{
+		lost:    make(chan struct{}),
+		ready:   make(chan struct{}),
+		pending: map[int]chan slackRtmEvent{},
+		team:    team,
+		backoff: newConnectionBackoff(),
+	}
+	session.outbound = newOutboundQueue(session.send, team.web, team.stop)
+	team.poster = session.outbound
+	return session
+}
+
+// current ...
+func (session *rtmSession) current() (websocketData, <-chan struct{}) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.wsClient, session.lost
+}
+
+// whenReady ...
+func (session *rtmSession) whenReady() <-chan struct{} {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.ready
+}
+
+// connect ...
+// Drops the current connection (if any) and blocks until a new one is up, or
+// we've given up on it (or the team is stopping). A reconnect_url slack gave us is tried first, since it
+// resumes without another rtm.start; unless resume is false (e.g. after a
+// team migration).
+func (session *rtmSession) connect(resume bool) error {
+	session.close()
+	if delay := session.backoff.beforeConnect(); delay > 0 {
+		log.Printf("Last connection for team [%s] didn't last; waiting %s before reconnecting", session.team.name(), delay)
+		if err := sleepUnlessStopped(delay, session.team.stop); err != nil {
+			return err
+		}
+	}
+	session.mu.Lock()
+	reconnectUrl := session.reconnectUrl
+	session.reconnectUrl = ""
+	session.mu.Unlock()
+
+	var wsClient websocketData
+	if resume && len(reconnectUrl) > 0 {
+		log.Printf("Resuming slack RTM for team [%s] via reconnect_url...", session.team.name())
+		var err error
+		if wsClient, err = connectWebsocket(reconnectUrl); err != nil {
+			log.Printf("Failed resuming via reconnect_url: %s", err)
+		}
+	}
+	if wsClient.ws == nil {
+		var err error
+		wsClient, err = connectWithRetry(fmt.Sprintf("slack RTM for team [%s]", session.team.name()), session.backoff.backoff, session.team.stop, func() (websocketData, error) {
+			return connAndCreateWsClient(session.team)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	session.mu.Lock()
+	session.wsClient = wsClient
+	session.lost = make(chan struct{})
+	session.mu.Unlock()
+	session.team.conn.set(connStateConnecting)
+	return nil
+}
+
+// close ...
+// Closes the current connection, if any; unacknowledged sends give up on it
+func (session *rtmSession) close() {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.wsClient.ws == nil {
+		return
+	}
+	session.wsClient.ws.Close()
+	session.wsClient = websocketData{}
+	close(session.lost)
+	session.ready = make(chan struct{})
+}
+
+// hello ...
+// Slack greets every new connection; only now may we send messages on it
+func (session *rtmSession) hello() {
+	session.backoff.established()
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	select {
+	case <-session.ready:
+	default:
+		close(session.ready)
+	}
+	session.team.conn.set(connStateConnected)
+}
+
+// setReconnectUrl ...
+func (session *rtmSession) setReconnectUrl(url string) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.reconnectUrl = url
+}
+
+// expectAck ...
+func (session *rtmSession) expectAck(id int) <-chan slackRtmEvent {
+	ack := make(chan slackRtmEvent, 1)
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.pending[id] = ack
+	return ack
+}
+
+// forgetAck ...
+func (session *rtmSession) forgetAck(id int) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	delete(session.pending, id)
+}
+
+// ack ...
+// Hands slack's reply to whoever sent the message it answers
+func (session *rtmSession) ack(reply slackRtmEvent) {
+	session.mu.Lock()
+	ack, ok := session.pending[reply.ReplyTo]
+	delete(session.pending, reply.ReplyTo)
+	session.mu.Unlock()
+	if !ok {
+		logDebug(fmt.Sprintf("Ignoring reply to unknown message [%d]", reply.ReplyTo))
+		return
+	}
+	ack <- reply
+}
+
+// send ...
+// Posts msg and waits for slack to acknowledge it. Messages which
+// go unacknowledged (usually because the connection dropped) are sent again
+// once we're reconnected, however long that takes, unless the team is
+// stopping; messages slack rejected are not. Only attempts which actually
+// sent something count towards rtmSendAttempts.
+func (session *rtmSession) send(msg slackMessage) (string, error) {
+	err := fmt.Errorf("not connected to slack")
+	for attempt := 1; attempt <= rtmSendAttempts; {
+		select {
+		case <-session.whenReady():
+		case <-session.team.stop:
+			select {
+			case <-session.whenReady():
+			default:
+				return "", fmt.Errorf("shutting down before message to channel [%s] was sent: %s", msg.Channel, err)
+			}
+		}
+		wsClient, lost := session.current()
+		if wsClient.ws == nil {
+			// torn down since it was ready; wait for the next connection
+			continue
+		}
+		if attempt > 1 {
+			log.Printf("Message to channel [%s] not acknowledged: %s; retrying (attempt %d)", msg.Channel, err, attempt)
+		}
+		attempt++
+		id := nextRtmMessageId()
+		ack := session.expectAck(id)
+		// If the socket is broken, the reader will notice and reconnect
+		if err = wsClient.sendRtmMessage(id, msg); err == nil {
+			select {
+			case reply := <-ack:
+				if !reply.Ok {
+					if reply.Error != nil {
+						return "", fmt.Errorf("slack rejected message [%d]: %s", id, reply.Error)
+					}
+					return "", fmt.Errorf("slack rejected message [%d]", id)
+				}
+				logDebug(fmt.Sprintf("Message [%d] acknowledged with ts [%s]", id, reply.Ts))
+				return reply.Ts, nil
+			case <-lost:
+				err = fmt.Errorf("connection lost before message [%d] was acknowledged", id)
+			case <-time.After(rtmAckTimeout):
+				err = fmt.Errorf("timed out waiting for acknowledgement of message [%d]", id)
+			}
+		}
+		session.forgetAck(id)
+		if err != nil {
+			// don't resend on the connection which just failed us; wait
+			// for the reader to notice and reconnect
+			select {
+			case <-lost:
+			case <-session.team.stop:
+			case <-time.After(rtmAckTimeout):
+			}
+		}
+	}
+	return "", err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// botIdentity is who slack knows us as, so we can ignore our own messages
+type botIdentity struct {
+	mu     sync.RWMutex
+	userId string
+	botId  string
+	teamId string
+}
+
+// set ...
+// botId may be empty (rtm.start doesn't tell us ours)
+func (b *botIdentity) set(userId string, botId string, teamId string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	logDebug(fmt.Sprintf("We are user [%s] bot [%s] in team [%s]", userId, botId, teamId))
+	b.userId = userId
+	b.teamId = teamId
+	if len(botId) > 0 {
+		b.botId = botId
+	}
+}
+
+// team ...
+// The ID of the team we're in, once known
+func (b *botIdentity) team() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.teamId
+}
+
+// is ...
+// True if a message from userId / botId was sent by us
+func (b *botIdentity) is(userId string, botId string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return (len(userId) > 0 && userId == b.userId) || (len(botId) > 0 && botId == b.botId)
+}
+
+// learnBotIdentity ...
+// Asks auth.test who our token belongs to, for transports without rtm.start
+func (team *slackTeam) learnBotIdentity() error {
+	auth, err := team.web.authTest()
+	if err != nil {
+		return err
+	}
+	team.self.set(auth.UserId, auth.BotId, auth.TeamId)
+	return nil
+}
+
+// ignoreMessage ...
+// Messages from ourselves, and from bots not in AllowedBots, are never
+// handled; answering them is how reply loops start. AllowedBots takes bot IDs,
+// bot usernames, or "@name" for a bot user in the directory.
+func (team *slackTeam) ignoreMessage(slackEvent slackRtmEvent) bool {
+	if slackEvent.Type != "message" {
+		return false
+	}
+	if slackEvent.Subtype == "message_changed" {
+		// judge an edit by who wrote the message
+		if slackEvent.Message != nil {
+			edited := *slackEvent.Message
+			edited.Type = slackEvent.Type
+			return team.ignoreMessage(edited)
+		}
+	}
+	if team.self.is(slackEvent.User, slackEvent.BotId) {
+		return true
+	}
+	if slackEvent.Subtype != "bot_message" && len(slackEvent.BotId) == 0 {
+		return false
+	}
+	for _, allowed := range team.config.AllowedBots {
+		if allowed == slackEvent.BotId || (len(slackEvent.Username) > 0 && allowed == slackEvent.Username) {
+			return false
+		}
+		if strings.HasPrefix(allowed, "@") && len(slackEvent.User) > 0 {
+			if id, err := team.directory.resolveUser(allowed); err == nil && id == slackEvent.User {
+				return false
+			}
+		}
+	}
+	return true
+}
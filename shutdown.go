@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How long in-flight work gets to finish once we're asked to stop
+const defaultShutdownTimeout = 10 * time.Second
+
+// shutdownTimeout ...
+func shutdownTimeout() time.Duration {
+	if config.ShutdownTimeout > 0 {
+		return time.Duration(config.ShutdownTimeout) * time.Second
+	}
+	return defaultShutdownTimeout
+}
+
+// shutdown ...
+// Asks the team's transport to stop taking on new events, finish what it's
+// doing and disconnect. Safe to call more than once.
+func (team *slackTeam) shutdown() {
+	team.stopOnce.Do(func() {
+		close(team.stop)
+	})
+}
+
+// giveUp ...
+// Stops just this team, for good, after it couldn't reach slack; the others
+// carry on without it
+func (team *slackTeam) giveUp(err error) {
+	log.Printf("Giving up on team [%s]: %s", team.name(), err)
+	team.conn.setError(err)
+	team.conn.set(connStateGaveUp)
+	team.shutdown()
+}
+
+// stopConnecting ...
+// Deals with a team whose connection attempts ended with err: either it was
+// asked to stop meanwhile, or we've given up on it
+func (team *slackTeam) stopConnecting(err error) {
+	if err != errStopping {
+		team.giveUp(err)
+		return
+	}
+	log.Printf("Stopped connecting team [%s] to slack", team.name())
+	team.finishWorkLogged()
+	team.conn.set(connStateDisconnected)
+}
+
+// finishWork ...
+// Waits, until deadline, for running handlers and then for everything they
+// queued to be delivered. False if the deadline came first.
+func (team *slackTeam) finishWork(deadline time.Time) bool {
+	finished := make(chan struct{})
+	go func() {
+		team.work.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+	if team.poster == nil {
+		return true
+	}
+	return team.poster.drain(deadline)
+}
+
+// finishWorkLogged ...
+// finishWork with the usual deadline, logging what became of it
+func (team *slackTeam) finishWorkLogged() {
+	log.Printf("Shutting down team [%s]; finishing in-flight work...", team.name())
+	if !team.finishWork(time.Now().Add(shutdownTimeout())) {
+		log.Printf("Gave up waiting for in-flight work for team [%s] after %s", team.name(), shutdownTimeout())
+	}
+}
+
+// shutdownOnSignal ...
+// Shuts every team down on SIGINT or SIGTERM. Should that take much longer
+// than the shutdown timeout, or another signal arrive, we exit regardless.
+func shutdownOnSignal(teams []*slackTeam) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Got %s; shutting down...", sig)
+		for _, team := range teams {
+			team.shutdown()
+		}
+		select {
+		case sig = <-signals:
+			log.Fatal(fmt.Sprintf("Got %s again; exiting now", sig))
+		case <-time.After(shutdownTimeout() + 5*time.Second):
+			log.Fatal("Shutdown is taking too long; exiting now")
+		}
+	}()
+}
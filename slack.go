@@ -2,165 +2,439 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 )
 
 // Once connected to RTM, all messages conform to this format
 // {"type":"message","channel":"STRING","user":"STRING","text":"hello","ts":"1467931915.000002","team":"STRING"}.
+// The other transports deliver the same events, so every event is decoded
+// into one of these as it arrives, and that is what handlers get.
 
 type slackRtmEvent struct {
 	Id      int    `json:"id,omitempty"`
 	Type    string `json:"type"`
+	Subtype string `json:"subtype,omitempty"`
 	Text    string `json:"text,omitempty"`
 	Channel string `json:"channel,omitempty"`
 	Team    string `json:"team,omitempty"`
 	User    string `json:"user,omitempty"`
 	Url     string `json:"url,omitempty"`
+	ReplyTo int    `json:"reply_to,omitempty"`
+	// Set on messages posted in (or starting) a thread
+	ThreadTs string `json:"thread_ts,omitempty"`
+	// Set on messages posted by bots (including us, via the Web API)
+	BotId    string `json:"bot_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	// Set on messages which have been edited
+	Edited *slackEdited `json:"edited,omitempty"`
+	Files  []slackFile  `json:"files,omitempty"`
+	// message_changed carries the edited message; message_deleted the ts it removed
+	Message         *slackRtmEvent `json:"message,omitempty"`
+	PreviousMessage *slackRtmEvent `json:"previous_message,omitempty"`
+	DeletedTs       string         `json:"deleted_ts,omitempty"`
+	// Every message has a ts; so do replies to messages we sent
+	Ts string `json:"ts,omitempty"`
+	// Only set on replies to messages we sent (and error events)
+	Ok    bool           `json:"ok,omitempty"`
+	Error *slackRtmError `json:"error,omitempty"`
+	// Events like user_change and channel_rename carry a whole user or
+	// channel where others have an ID; User and Channel get the ID either way
+	UserInfo    *slackUser    `json:"-"`
+	ChannelInfo *slackChannel `json:"-"`
+	// The event exactly as slack sent it
+	Raw json.RawMessage `json:"-"`
 }
 
-// The only output from a rtm.start we care about is the websocket url
-type slackRtmStartResp struct {
-	Url string
+// {"user":"U2147483697","ts":"1355517536.000001"}
+type slackEdited struct {
+	User string `json:"user"`
+	Ts   string `json:"ts"`
 }
 
-type httpClient struct {
-	client *http.Client
+type slackFile struct {
+	Id         string `json:"id"`
+	Name       string `json:"name,omitempty"`
+	Title      string `json:"title,omitempty"`
+	Mimetype   string `json:"mimetype,omitempty"`
+	UrlPrivate string `json:"url_private,omitempty"`
+	Permalink  string `json:"permalink,omitempty"`
 }
 
-var store struct {
-	DilbertBackOffUntil time.Time
-	//LastRtmConnectEpoch int64
+// UnmarshalJSON ...
+// Decodes an event, sorting out whether "user" and "channel" are IDs or
+// objects. A field of some unexpected type is left empty rather than losing
+// the whole event over it.
+func (slackEvent *slackRtmEvent) UnmarshalJSON(data []byte) error {
+	// plain has our fields but not this method
+	type plain slackRtmEvent
+	decoded := struct {
+		*plain
+		User    json.RawMessage `json:"user,omitempty"`
+		Channel json.RawMessage `json:"channel,omitempty"`
+	}{plain: (*plain)(slackEvent)}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		if _, ok := err.(*json.UnmarshalTypeError); !ok {
+			return err
+		}
+		logDebug(fmt.Sprintf("Ignoring part of event: %s", err))
+	}
+	if len(decoded.User) > 0 && decoded.User[0] == '{' {
+		slackEvent.UserInfo = &slackUser{}
+		json.Unmarshal(decoded.User, slackEvent.UserInfo)
+		slackEvent.User = slackEvent.UserInfo.Id
+	} else if len(decoded.User) > 0 {
+		json.Unmarshal(decoded.User, &slackEvent.User)
+	}
+	if len(decoded.Channel) > 0 && decoded.Channel[0] == '{' {
+		slackEvent.ChannelInfo = &slackChannel{}
+		json.Unmarshal(decoded.Channel, slackEvent.ChannelInfo)
+		slackEvent.Channel = slackEvent.ChannelInfo.Id
+	} else if len(decoded.Channel) > 0 {
+		json.Unmarshal(decoded.Channel, &slackEvent.Channel)
+	}
+	slackEvent.Raw = append(json.RawMessage(nil), data...)
+	return nil
 }
 
-// Per slack docs, this is the maximum size
-const slackMsgSizeCapBytes = 16000
+// {"code":2,"msg":"message text is missing"}
+type slackRtmError struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
 
-var clientConfig = &http.Client{Timeout: time.Duration(time.Duration(30) * time.Second)}
-var client = httpClient{clientConfig}
+func (e *slackRtmError) String() string {
+	return fmt.Sprintf("code [%d] msg [%s]", e.Code, e.Msg)
+}
+
+// Error ...
+func (e *slackRtmError) Error() string {
+	return e.String()
+}
 
-// createSlackPost ...
-// Given a message and a channel name, return json suitable for posting to slack
-func (wsClient *websocketData) createSlackPost(msg string, channel string) {
-	payload := slackRtmEvent{
-		Id:      1,
-		Type:    "message",
-		Channel: channel,
-		Text:    msg,
+// The only output from a rtm.start we care about is the websocket url (or why
+// there isn't one), who we are, and who and what else is in the team
+type slackRtmStartResp struct {
+	Url   string
+	Error string
+	Self  struct {
+		Id   string
+		Name string
 	}
-	jPayload, err := json.Marshal(payload)
-	if err != nil {
-		log.Fatal(fmt.Sprintf("Error encoding slackRtmEvent payload: %s", err))
+	Team struct {
+		Id string
 	}
-	wsClient.writeSocket(jPayload)
+	Users    []slackUser
+	Channels []slackChannel
+	// private channels
+	Groups []slackChannel
+}
+
+// slackPoster is anything able to deliver a message to a slack channel. The
+// returned channel reports whether delivery succeeded.
+type slackPoster interface {
+	createSlackPost(msg string, channel string) <-chan slackPostResult
+	// createRichSlackPost always goes through chat.postMessage, for
+	// attachments, blocks, threads or text too long for RTM
+	createRichSlackPost(msg slackMessage) <-chan slackPostResult
+	// sendSlackMessage is createSlackPost for messages with more than text,
+	// such as thread replies
+	sendSlackMessage(msg slackMessage) <-chan slackPostResult
+	// updateSlackMessage replaces the message at msg.Channel / msg.Ts
+	updateSlackMessage(msg slackMessage) <-chan slackPostResult
+	deleteSlackMessage(channel string, ts string) <-chan slackPostResult
+	// drain waits, until deadline, for everything queued to be delivered
+	drain(deadline time.Time) bool
+}
+
+type httpClient struct {
+	client *http.Client
 }
 
-func connAndCreateWsClient() websocketData {
-	wssUrl := rtmStart()
-	ws := connectWebsocket(wssUrl)
-	wsClient := websocketData{ws}
-	return wsClient
+var clientConfig = &http.Client{Timeout: time.Duration(time.Duration(30) * time.Second)}
+var client = httpClient{clientConfig}
+
+func connAndCreateWsClient(team *slackTeam) (websocketData, error) {
+	wssUrl, err := rtmStart(team)
+	if err != nil {
+		return websocketData{}, err
+	}
+	return connectWebsocket(wssUrl)
 }
 
 // connectToSlack ...
-func connectToSlack() {
-	wsClient := connAndCreateWsClient()
+func connectToSlack(team *slackTeam) {
+	session := newRtmSession(team)
+	if err := session.connect(false); err != nil {
+		team.stopConnecting(err)
+		return
+	}
+	recorder.recordSelf(team)
+	wsClient, _ := session.current()
+	done := make(chan struct{})
+	frames := wsClient.startReader(done)
+	keepalive := newRtmKeepalive()
+	ticker := time.NewTicker(keepalive.interval)
+	defer ticker.Stop()
+
+	// Once asked to stop, we keep reading (slack's acks of our last few
+	// messages arrive here) but hand nothing new to the handlers
+	stop := team.stop
+	var finished chan struct{}
+	disconnect := func() {
+		close(done)
+		session.close()
+		team.conn.set(connStateDisconnected)
+	}
+	// reconnect returns false if we're shutting down instead
+	reconnect := func(state connState) bool {
+		if finished != nil {
+			log.Printf("Lost connection to slack while shutting down team [%s]", team.name())
+			disconnect()
+			return false
+		}
+		team.conn.set(state)
+		close(done)
+		if err := session.connect(state != connStateMigrating); err != nil {
+			team.stopConnecting(err)
+			return false
+		}
+		recorder.recordSelf(team)
+		wsClient, _ = session.current()
+		done = make(chan struct{})
+		frames = wsClient.startReader(done)
+		keepalive.reset()
+		return true
+	}
+
 	for {
-		// slack, you are evil
-		slackTimeout := make(chan bool, 1)
-		go func() {
-			time.Sleep(90 * time.Second)
-			slackTimeout <- true
-		}()
-
-		message := make(chan []byte)
-		go func() {
-			message <- wsClient.readSocket()
-			close(message)
-		}()
 		select {
-		case readFromSlack := <-message:
-			log.Printf("received: %s", readFromSlack)
+		case <-stop:
+			stop = nil
+			finished = make(chan struct{})
+			go func() {
+				team.finishWorkLogged()
+				close(finished)
+			}()
+		case <-finished:
+			disconnect()
+			log.Printf("Disconnected team [%s] from slack", team.name())
+			return
+		case frame := <-frames:
+			if frame.err != nil {
+				log.Printf("Error reading from slack [%s]. Attempting reconnection...", frame.err)
+				team.conn.setError(frame.err)
+				if !reconnect(connStateReconnecting) {
+					return
+				}
+				continue
+			}
+			readFromSlack := frame.data
+			recorder.record(team, readFromSlack)
 
 			var slackEvent slackRtmEvent
-			readFromSlack = bytes.Trim(readFromSlack, "\x00")
 			if unencodeErr := json.Unmarshal(readFromSlack, &slackEvent); unencodeErr != nil {
 				log.Printf("Invalid json received from slack? [%s]", unencodeErr)
+				continue
+			}
+			if slackEvent.Type == "pong" {
+				keepalive.pong(slackEvent.ReplyTo)
+				continue
+			}
+			if len(slackEvent.Type) == 0 && slackEvent.ReplyTo > 0 {
+				session.ack(slackEvent)
+				continue
 			}
-			if slackEvent.Type == "team_migration_started" {
+			log.Printf("received: %s", readFromSlack)
+			switch slackEvent.Type {
+			case "hello":
+				log.Printf("Slack said hello; connected")
+				session.hello()
+			case "goodbye":
+				log.Printf("Slack said goodbye. Reconnecting...")
+				if !reconnect(connStateReconnecting) {
+					return
+				}
+				continue
+			case "reconnect_url":
+				logDebug(fmt.Sprintf("Will resume via [%s] if disconnected", slackEvent.Url))
+				session.setReconnectUrl(slackEvent.Url)
+				continue
+			case "error":
+				if slackEvent.Error != nil {
+					log.Printf("Slack sent an error: %s", slackEvent.Error)
+					team.conn.setError(slackEvent.Error)
+				} else {
+					log.Printf("Slack sent an error without details: %s", readFromSlack)
+				}
+				continue
+			case "team_migration_started":
+				// Our reconnect_url points at the old host, so start over with
+				// rtm.start; the backoff absorbs failures while migration finishes
 				log.Printf("Team migration started. Will need to reconnect!")
-				time.Sleep(time.Second * 10)
-				wsClient = connAndCreateWsClient()
-			} else {
-				dilbertRoutine(wsClient)
-				processJiraReq(wsClient, readFromSlack)
+				if !reconnect(connStateMigrating) {
+					return
+				}
+				continue
+			}
+			if finished != nil {
+				logDebug(fmt.Sprintf("Shutting down; not handling [%s]", slackEvent.Type))
+				continue
+			}
+			handleSlackEvent(team, slackEvent)
+		case now := <-ticker.C:
+			if keepalive.dead(now) {
+				log.Printf("No pong from slack since [%s]! Attempting reconnection...", keepalive.lastPong)
+				if !reconnect(connStateReconnecting) {
+					return
+				}
+				continue
+			}
+			if err := keepalive.sendPing(&wsClient); err != nil {
+				log.Printf("Error sending ping to slack [%s]. Attempting reconnection...", err)
+				if !reconnect(connStateReconnecting) {
+					return
+				}
 			}
-		case <-slackTimeout:
-			// damn you slack
-			log.Printf("Hit slackTimeout! Attempting reconnection...")
-			wsClient = connAndCreateWsClient()
 		}
 	}
 }
 
-func processJiraReq(wsClient websocketData, readFromSlack []byte) {
-	if isJiraIssueUrlRequest(readFromSlack) {
-		jiraIssues, slackChannel, err := getJiraIssues(readFromSlack)
-		if err == nil {
-			for v := range jiraIssues {
-				jiraIssue := strings.Replace(jiraIssues[v], "jira#", "", 1)
-				subject, description, err := getJiraIssueDetails(jiraIssue)
-				if err != nil {
-					wsClient.createSlackPost(fmt.Sprintf("Error when fetching jira issue [%s]: %s :rage:", jiraIssue, err), slackChannel)
-				} else {
-					// Show description if requested
-					if jiraIssueDescriptionRequested(readFromSlack) {
-						wsClient.createSlackPost(fmt.Sprintf("*[jira#%s] Description:* :point_down:\n%s", jiraIssue, description), slackChannel)
-					} else {
-						wsClient.createSlackPost(fmt.Sprintf("%s/browse/%s :point_left:\n*Subject:* [%s]", config.JiraUrl, jiraIssue, subject), slackChannel)
-					}
-				}
-			}
+// isRtmConnectionEvent ...
+// Events about the RTM connection itself, which the handlers never see
+func isRtmConnectionEvent(eventType string) bool {
+	switch eventType {
+	case "pong", "goodbye", "reconnect_url", "error", "team_migration_started":
+		return true
+	}
+	return false
+}
+
+// handleSlackEvent ...
+// Hands a single event to the team's workers, which run every feature against
+// it no matter which transport delivered it. Events for one channel are
+// handled in the order they arrived.
+func handleSlackEvent(team *slackTeam, slackEvent slackRtmEvent) {
+	team.work.Add(1)
+	queued := team.workers.submit(slackEvent.Channel, func() {
+		defer team.work.Done()
+		handlers.dispatch(team, slackEvent)
+	})
+	if !queued {
+		team.work.Done()
+		log.Printf("Dropped [%s] event for channel [%s] in team [%s]", slackEvent.Type, slackEvent.Channel, team.name())
+	}
+}
+
+// replyTo ...
+// Builds a reply to slackEvent, threaded according to the channel's settings
+func (team *slackTeam) replyTo(slackEvent slackRtmEvent, reply slackMessage) slackMessage {
+	reply.Channel = slackEvent.Channel
+	settings := team.channelSettings(slackEvent.Channel)
+	switch settings.ThreadReplies {
+	case threadRepliesNever:
+		return reply
+	case threadRepliesAlways:
+		reply.ThreadTs = slackEvent.ThreadTs
+		if len(reply.ThreadTs) == 0 {
+			reply.ThreadTs = slackEvent.Ts
+		}
+	default:
+		reply.ThreadTs = slackEvent.ThreadTs
+	}
+	if len(reply.ThreadTs) > 0 {
+		reply.ReplyBroadcast = settings.BroadcastThreadReplies
+	}
+	return reply
+}
+
+func processJiraReq(ctx context.Context, team *slackTeam, slackEvent slackRtmEvent) {
+	replies := jiraReplies(ctx, team, slackEvent)
+	if len(replies) == 0 || handlerCancelled(ctx, team, "jira replies") {
+		return
+	}
+	var delivered []<-chan slackPostResult
+	for _, reply := range replies {
+		delivered = append(delivered, team.poster.createRichSlackPost(team.replyTo(slackEvent, reply)))
+	}
+	// remember what we said, in case the message is edited or deleted later
+	team.replies.track(slackEvent.Channel, slackEvent.Ts, nil, delivered)
+}
+
+// jiraReplies ...
+// Everything we have to say about the jira issues mentioned in a message
+func jiraReplies(ctx context.Context, team *slackTeam, slackEvent slackRtmEvent) []slackMessage {
+	var replies []slackMessage
+	if _, _, isComment := getJiraComment(slackEvent); isComment {
+		// processJiraComment has that covered
+		return replies
+	}
+	jiraIssues, err := team.jiraIssuesMentioned(slackEvent)
+	if err != nil {
+		return append(replies, slackMessage{Text: err.Error()})
+	}
+	for _, jiraIssue := range jiraIssues {
+		issue, err := getJiraIssue(ctx, team, jiraIssue)
+		if err != nil {
+			replies = append(replies, slackMessage{Text: fmt.Sprintf("Error when fetching jira issue [%s]: %s :rage:", jiraIssue, err)})
 		} else {
-			wsClient.createSlackPost(fmt.Sprintf("%s", err), slackChannel)
+			// Show description if requested
+			if jiraIssueDescriptionRequested(slackEvent) {
+				replies = append(replies, slackMessage{Text: fmt.Sprintf("*[jira#%s] Description:* :point_down:\n%s", jiraIssue, issue.Fields.Description.mrkdwn())})
+			} else {
+				replies = append(replies, jiraIssueUnfurl(team.config.JiraUrl, issue, team.directory))
+			}
 		}
 	}
+	return replies
 }
 
 // rtmStart ...
-func rtmStart() string {
-	log.Printf("Attempting rtm.start [%s]...", config.SlackApiUrl)
+func rtmStart(team *slackTeam) (string, error) {
+	apiUrl := team.config.SlackApiUrl
+	log.Printf("Attempting rtm.start [%s]...", apiUrl)
 	// Slack just uses query strings here...
 	// https://api.slack.com/methods/rtm.start/test
 	var payload []byte
-	resp, err := client.client.Post(fmt.Sprintf("%s/rtm.start?token=%s", config.SlackApiUrl, config.SlackApiToken), "application/json;charset=UTF-8", bytes.NewReader(payload))
+	resp, err := client.client.Post(fmt.Sprintf("%s/rtm.start?token=%s", apiUrl, team.config.SlackApiToken), "application/json;charset=UTF-8", bytes.NewReader(payload))
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Error in /rtm.start POST request to [%s]: %s", config.SlackApiUrl, err))
+		return "", fmt.Errorf("Error in /rtm.start POST request to [%s]: %s", apiUrl, err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		log.Fatal(fmt.Sprintf("Got http code [%d] back from [%s]", resp.StatusCode, config.SlackApiUrl))
+		return "", fmt.Errorf("Got http code [%d] back from [%s]", resp.StatusCode, apiUrl)
 	}
-	logDebug(fmt.Sprintf("Got http code [%d] back from [%s]", resp.StatusCode, config.SlackApiUrl))
+	logDebug(fmt.Sprintf("Got http code [%d] back from [%s]", resp.StatusCode, apiUrl))
 
 	// Read response body into byte slice
 	bsRb, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal("Error reading response body: %s", err)
+		return "", fmt.Errorf("Error reading response body: %s", err)
 	}
 
 	// json decode the slice, so we can get the websocket URL
 	var rtm slackRtmStartResp
 	jsonDecodeErr := json.Unmarshal(bsRb, &rtm)
 	if jsonDecodeErr != nil {
-		log.Fatal("Error JSON decoding response body: %s", jsonDecodeErr)
+		return "", fmt.Errorf("Error JSON decoding response body: %s", jsonDecodeErr)
+	}
+	if len(rtm.Url) == 0 {
+		return "", fmt.Errorf("rtm.start returned no websocket url: %s", rtm.Error)
+	}
+
+	team.self.set(rtm.Self.Id, "", rtm.Team.Id)
+	if len(rtm.Users) > 0 || len(rtm.Channels) > 0 {
+		team.directory.load(rtm.Users, append(rtm.Channels, rtm.Groups...))
+	} else if err := team.loadDirectory(); err != nil {
+		// rtm.start can be asked to leave these out; names just won't resolve
+		log.Printf("Error loading users and channels for team [%s]: %s", team.name(), err)
 	}
 
 	logDebug(fmt.Sprintf("Offered websocket URL: [%s]", rtm.Url))
-	return rtm.Url
+	return rtm.Url, nil
 }
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectToSlackAnswersJiraRequests(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-1", "Fix the thing")
+	fs.startBot(teamConfig{})
+
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"see jira#ABC-1","ts":"1500000001.000001"}`)
+	post := fs.awaitPost()
+	if post.Method != "chat.postMessage" || post.Message.Channel != "C1" || len(post.Message.Attachments) != 1 {
+		t.Fatalf("Expected a card in C1, got %+v", post)
+	}
+	card := post.Message.Attachments[0]
+	if card.Title != "ABC-1: Fix the thing" || card.TitleLink != fs.url()+"/browse/ABC-1" {
+		t.Errorf("Unexpected card title [%s] linking to [%s]", card.Title, card.TitleLink)
+	}
+	if card.Color != jiraStatusColors["indeterminate"] || card.Footer != "Created 2017-06-20 · Updated 2017-06-21" {
+		t.Errorf("Unexpected card %+v", card)
+	}
+	// jira's alice is slack's @alice
+	for _, field := range card.Fields {
+		if field.Title == "Assignee" && field.Value != "<@U1>" {
+			t.Errorf("Expected the assignee to be mentioned, got [%s]", field.Value)
+		}
+	}
+}
+
+func TestJiraDescriptionAndErrors(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-2", "Fix the other thing")
+	fs.startBot(teamConfig{})
+
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-2.describe","ts":"1500000001.000001"}`)
+	if post := fs.awaitPost(); post.Message.Text != "*[jira#ABC-2] Description:* :point_down:\nAll about ABC-2" {
+		t.Errorf("Unexpected description reply [%s]", post.Message.Text)
+	}
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#NOPE-1","ts":"1500000001.000002"}`)
+	if post := fs.awaitPost(); post.Method != "chat.postMessage" || !strings.Contains(post.Message.Text, "Error when fetching jira issue [NOPE-1]") {
+		t.Errorf("Expected an error reply, got [%s] via [%s]", post.Message.Text, post.Method)
+	}
+}
+
+func TestJiraRepliesFollowChannelThreading(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-3", "Thread me")
+	fs.startBot(teamConfig{Channels: map[string]channelConfig{"#general": {ThreadReplies: threadRepliesAlways}}})
+
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-3","ts":"1500000001.000001"}`)
+	if post := fs.awaitPost(); post.Message.ThreadTs != "1500000001.000001" {
+		t.Errorf("Expected a reply in the thread of 1500000001.000001, got %+v", post)
+	}
+}
+
+func TestIgnoresOwnMessages(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-4", "Loop")
+	fs.startBot(teamConfig{})
+
+	fs.send(`{"type":"message","channel":"C1","user":"UBOT","text":"jira#ABC-4","ts":"1500000001.000001"}`)
+	fs.expectNoPost(2 * time.Second)
+}
+
+func TestJiraRepliesFollowEdits(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-5", "Before")
+	fs.addIssue("ABC-6", "After")
+	fs.startBot(teamConfig{})
+
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-5","ts":"1500000001.000001"}`)
+	reply := fs.awaitPost()
+	fs.send(`{"type":"message","subtype":"message_changed","channel":"C1",` +
+		`"message":{"type":"message","user":"U1","text":"jira#ABC-6","ts":"1500000001.000001"},` +
+		`"previous_message":{"type":"message","user":"U1","text":"jira#ABC-5","ts":"1500000001.000001"}}`)
+	update := fs.awaitPost()
+	if update.Method != "chat.update" || update.Message.Ts != reply.Message.Ts || unfurlTitle(update) != "ABC-6: After" {
+		t.Fatalf("Expected reply %s to be updated, got %+v", reply.Message.Ts, update)
+	}
+	fs.send(`{"type":"message","subtype":"message_deleted","channel":"C1","deleted_ts":"1500000001.000001"}`)
+	if deleted := fs.awaitPost(); deleted.Method != "chat.delete" || deleted.Message.Ts != reply.Message.Ts {
+		t.Fatalf("Expected reply %s to be deleted, got %+v", reply.Message.Ts, deleted)
+	}
+}
+
+func TestJiraCommentFromSlack(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-9", "Discuss")
+	fs.startBot(teamConfig{})
+
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-9.comment we agreed on ~plan A~ *plan B*, see <https://example.com|the doc> &amp; ask <@U1>","ts":"1500000001.000001"}`)
+	post := fs.awaitPost()
+	want := fmt.Sprintf(":speech_balloon: <%s/browse/ABC-9?focusedCommentId=10001#comment-10001|Comment added> to ABC-9", fs.url())
+	if post.Message.Text != want || post.Message.ThreadTs != "1500000001.000001" {
+		t.Fatalf("Expected [%s] in the thread of 1500000001.000001, got %+v", want, post)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	wantBody := "we agreed on -plan A- *plan B*, see [the doc|https://example.com] & ask @alice\n\n" +
+		"_— alice, via [Slack|https://example.slack.com/archives/C1/p1500000001000001]_"
+	if len(fs.comments["ABC-9"]) != 1 || fs.comments["ABC-9"][0] != wantBody {
+		t.Errorf("Expected the comment [%s], got %q", wantBody, fs.comments["ABC-9"])
+	}
+}
+
+func TestJiraCommentOnMissingIssue(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.startBot(teamConfig{})
+
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#NOPE-1.comment hello","ts":"1500000001.000001"}`)
+	post := fs.awaitPost()
+	if !strings.Contains(post.Message.Text, "Error commenting on jira issue [NOPE-1]") || !strings.Contains(post.Message.Text, "Issue does not exist") {
+		t.Errorf("Expected an explanation of the error, got [%s]", post.Message.Text)
+	}
+	// and no card for NOPE-1 from the jira handler
+	fs.expectNoPost(500 * time.Millisecond)
+}
+
+func TestJiraCreateFromSlack(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.startBot(teamConfig{})
+
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira create abc new feature Export &amp; import\nSo that <@U1> can move data.","ts":"1500000001.000001"}`)
+	post := fs.awaitPost()
+	want := fmt.Sprintf(":white_check_mark: Created <%s/browse/ABC-101|ABC-101>: Export &amp; import", fs.url())
+	if post.Message.Text != want {
+		t.Fatalf("Expected [%s], got [%s]", want, post.Message.Text)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if len(fs.created) != 1 {
+		t.Fatalf("Expected one issue to be created, got %v", fs.created)
+	}
+	fields := fs.created[0]
+	wantDescription := "So that @alice can move data.\n\n_— alice, via [Slack|https://example.slack.com/archives/C1/p1500000001000001]_"
+	if fields["summary"] != "Export & import" || fields["description"] != wantDescription {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+	if fmt.Sprint(fields["project"]) != "map[key:ABC]" || fmt.Sprint(fields["issuetype"]) != "map[id:2]" {
+		t.Errorf("Expected a New Feature in ABC, got %v", fields)
+	}
+}
+
+func TestJiraCreateErrors(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.startBot(teamConfig{})
+
+	for _, tc := range []struct {
+		text string
+		want string
+	}{
+		{"jira create ABC", "Usage: `jira create PROJ"},
+		{"jira create XYZ Bug Broken", "there's no project [XYZ]"},
+		{"jira create ABC Epic Everything", "try one of: Bug, New, New Feature"},
+		{"jira create ABC Sub-task Part", "try one of: Bug, New, New Feature"},
+		{"jira create ABC Bug", "the Bug needs a summary"},
+		{"jira create ABC Bug This summary is far too long for the fake jira", "jira refused the issue: summary: Summary must be less than 40 characters."},
+	} {
+		fs.send(fmt.Sprintf(`{"type":"message","channel":"C1","user":"U1","text":%q,"ts":"1500000001.000001"}`, tc.text))
+		if post := fs.awaitPost(); !strings.Contains(post.Message.Text, tc.want) {
+			t.Errorf("Expected [%s] to be answered with [%s], got [%s]", tc.text, tc.want, post.Message.Text)
+		}
+	}
+}
+
+func TestJiraCreateWithEveryCreateMeta(t *testing.T) {
+	for _, flavor := range []string{"", "cloud", "legacy"} {
+		fs := newFakeSlack(t)
+		fs.jiraFlavor = flavor
+		fs.startBot(teamConfig{})
+		for _, tc := range []struct {
+			text string
+			want string
+		}{
+			{"jira create XYZ Bug Broken", "there's no project [XYZ]"},
+			{"jira create ABC New Feature Works", "Created"},
+		} {
+			fs.send(fmt.Sprintf(`{"type":"message","channel":"C1","user":"U1","text":%q,"ts":"1500000001.000001"}`, tc.text))
+			if post := fs.awaitPost(); !strings.Contains(post.Message.Text, tc.want) {
+				t.Errorf("Expected [%s] to be answered with [%s] by %q jira, got [%s]", tc.text, tc.want, flavor, post.Message.Text)
+			}
+		}
+		fs.mu.Lock()
+		if len(fs.created) != 1 || fmt.Sprint(fs.created[0]["issuetype"]) != "map[id:2]" {
+			t.Errorf("Expected a New Feature to be created by %q jira, got %v", flavor, fs.created)
+		}
+		fs.mu.Unlock()
+	}
+}
+
+func TestEditingCardIntoErrorDropsTheCard(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-10", "Card")
+	fs.startBot(teamConfig{})
+
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-10","ts":"1500000001.000001"}`)
+	reply := fs.awaitPost()
+	fs.send(`{"type":"message","subtype":"message_changed","channel":"C1",` +
+		`"message":{"type":"message","user":"U1","text":"jira#NOPE-10","ts":"1500000001.000001"},` +
+		`"previous_message":{"type":"message","user":"U1","text":"jira#ABC-10","ts":"1500000001.000001"}}`)
+	update := fs.awaitPost()
+	if update.Method != "chat.update" || update.Message.Ts != reply.Message.Ts || !strings.Contains(update.Message.Text, "[NOPE-10]") {
+		t.Fatalf("Expected reply %s to become an error, got %+v", reply.Message.Ts, update)
+	}
+	if !strings.Contains(string(update.Raw), `"attachments":[]`) {
+		t.Errorf("Expected the card to be removed explicitly, got [%s]", update.Raw)
+	}
+}
+
+func TestDilbertPostedOncePerDay(t *testing.T) {
+	fs := newFakeSlack(t)
+	defer func(stripUrl string, firstHour int) {
+		dilbertStripUrl, dilbertFirstHour = stripUrl, firstHour
+	}(dilbertStripUrl, dilbertFirstHour)
+	dilbertStripUrl = fs.url() + "/strip/%s"
+	dilbertFirstHour = 0
+	// hello alone is enough of an event to go looking
+	team := fs.startBot(teamConfig{SlackDilbertChannel: "#general"})
+	defer os.RemoveAll(getDilbertPostedDir(team))
+
+	year, month, day := time.Now().Date()
+	want := fmt.Sprintf(dilbertStripUrl, fmt.Sprintf("%d-%s-%d", year, month, day))
+	post := fs.awaitPost()
+	if post.Message.Channel != "C1" || post.Message.Text != want+"\n" {
+		t.Fatalf("Expected [%s] posted to C1, got %+v", want, post)
+	}
+	fs.send(`{"type":"user_typing","channel":"C1","user":"U1"}`)
+	fs.expectNoPost(2 * time.Second)
+	if len(fs.strips) != 1 {
+		t.Errorf("Expected one request for the strip, got %d", len(fs.strips))
+	}
+}
+
+// heldPoster ...
+// Has nothing queued as far as shutdown can tell, but only reports delivery
+// of what it's given once the test says so
+type heldPoster struct {
+	slackPoster
+	delivered chan slackPostResult
+}
+
+func (p *heldPoster) createSlackPost(msg string, channel string) <-chan slackPostResult {
+	return p.delivered
+}
+
+func (p *heldPoster) drain(deadline time.Time) bool {
+	return true
+}
+
+func TestShutdownWaitsForDilbertDelivery(t *testing.T) {
+	fs := newFakeSlack(t)
+	defer func(stripUrl string, firstHour int) {
+		dilbertStripUrl, dilbertFirstHour = stripUrl, firstHour
+	}(dilbertStripUrl, dilbertFirstHour)
+	dilbertStripUrl = fs.url() + "/strip/%s"
+	dilbertFirstHour = 0
+	team := newSlackTeam(teamConfig{Name: t.Name(), SlackDilbertChannel: "C1"})
+	defer os.RemoveAll(getDilbertPostedDir(team))
+	poster := &heldPoster{delivered: make(chan slackPostResult, 1)}
+	team.poster = poster
+
+	dilbertRoutine(context.Background(), team)
+	if team.finishWork(time.Now().Add(200 * time.Millisecond)) {
+		t.Fatal("Expected shutdown to wait for dilbert to be delivered")
+	}
+	poster.delivered <- slackPostResult{Err: fmt.Errorf("not delivered")}
+	if !team.finishWork(time.Now().Add(fakeSlackTimeout)) {
+		t.Fatal("Expected nothing left once dilbert's delivery failed")
+	}
+	if pathExists(getTodaysDilbertFile(team)) {
+		t.Error("Expected a failed dilbert to be forgotten before shutdown finished")
+	}
+}
+
+func TestReconnectsAfterConnectionDrops(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-7", "Still here")
+	team := fs.startBot(teamConfig{})
+
+	fs.dropConnection()
+	fs.awaitConnection()
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-7","ts":"1500000001.000001"}`)
+	if post := fs.awaitPost(); unfurlTitle(post) != "ABC-7: Still here" {
+		t.Errorf("Unexpected reply after reconnecting [%s]", unfurlTitle(post))
+	}
+	if state, _ := team.conn.get(); state != connStateConnected {
+		t.Errorf("Expected to be connected, but are %s", state)
+	}
+}
+
+func TestReconnectsAfterGoodbyeAndFailedStarts(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.startBot(teamConfig{})
+
+	fs.mu.Lock()
+	fs.rtmStartFailures = fs.rtmStarts + 1
+	fs.mu.Unlock()
+	fs.send(`{"type":"goodbye"}`)
+	fs.awaitConnection()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.rtmStarts != 3 {
+		t.Errorf("Expected 3 calls to rtm.start, got %d", fs.rtmStarts)
+	}
+}
+
+func TestGivesUpOnlyOnTheTeamThatCantConnect(t *testing.T) {
+	saved := config.ReconnectGiveUpAttempts
+	defer func() { config.ReconnectGiveUpAttempts = saved }()
+	config.ReconnectGiveUpAttempts = 2
+
+	healthy := newFakeSlack(t)
+	healthy.addIssue("ABC-1", "Still here")
+	healthy.startBot(teamConfig{})
+
+	unreachable := newFakeSlack(t)
+	unreachable.rtmStartFailures = 1000
+	team := newSlackTeam(teamConfig{Name: "unreachable", SlackApiUrl: unreachable.url(), SlackApiToken: "xoxb-test"})
+	gaveUp := make(chan struct{})
+	go func() {
+		defer close(gaveUp)
+		connectToSlack(team)
+	}()
+	select {
+	case <-gaveUp:
+	case <-time.After(fakeSlackTimeout):
+		t.Fatal("Expected to give up on the unreachable team")
+	}
+	if state, _ := team.conn.get(); state != connStateGaveUp {
+		t.Errorf("Expected the unreachable team to have given up, but it's %s", state)
+	}
+	if err, _ := team.conn.getError(); err == nil || !strings.Contains(err.Error(), "gave up connecting") {
+		t.Errorf("Expected why we gave up to be kept, got [%v]", err)
+	}
+	if reasons := lastErrors([]*slackTeam{team}); !strings.Contains(reasons, "team [unreachable]") {
+		t.Errorf("Expected the unreachable team's error when explaining why we exit, got [%s]", reasons)
+	}
+
+	healthy.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-1","ts":"1500000001.000001"}`)
+	if post := healthy.awaitPost(); unfurlTitle(post) != "ABC-1: Still here" {
+		t.Errorf("Expected the other team to carry on, got [%s]", unfurlTitle(post))
+	}
+}
+
+func TestStopsWhileSlackIsUnreachable(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.rtmStartFailures = 1000
+	team := newSlackTeam(teamConfig{Name: t.Name(), SlackApiUrl: fs.url(), SlackApiToken: "xoxb-test"})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		connectToSlack(team)
+	}()
+	for {
+		fs.mu.Lock()
+		starts := fs.rtmStarts
+		fs.mu.Unlock()
+		if starts >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// we're now waiting at least a second before the third attempt
+	team.shutdown()
+	select {
+	case <-stopped:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Expected to stop without waiting out the backoff")
+	}
+	if state, _ := team.conn.get(); state != connStateDisconnected {
+		t.Errorf("Expected to be disconnected, but are %s", state)
+	}
+}
+
+func TestReconnectsWhenPongsStop(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.startBot(teamConfig{})
+
+	fs.mu.Lock()
+	fs.ignorePings = true
+	fs.mu.Unlock()
+	fs.awaitConnection()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.rtmStarts != 2 {
+		t.Errorf("Expected 2 calls to rtm.start, got %d", fs.rtmStarts)
+	}
+}
+
+func TestBacksOffWhenConnectionsDropStraightAway(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.startBot(teamConfig{})
+
+	fs.mu.Lock()
+	fs.dropAfterHello = true
+	fs.mu.Unlock()
+	fs.dropConnection()
+	time.Sleep(3 * time.Second)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	// 1s, 2s, 4s... jittered down by up to half
+	if fs.rtmStarts > 5 {
+		t.Errorf("Expected reconnects to back off, but rtm.start was called %d times in 3s", fs.rtmStarts)
+	}
+}
+
+func TestShutdownFinishesInFlightReplies(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-8", "Almost done")
+	release := fs.holdIssue("ABC-8")
+	team := fs.startBot(teamConfig{})
+
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-8","ts":"1500000001.000001"}`)
+	fs.awaitJiraRequest("ABC-8")
+	team.shutdown()
+	release()
+	if post := fs.awaitPost(); unfurlTitle(post) != "ABC-8: Almost done" {
+		t.Errorf("Unexpected reply while shutting down [%s]", unfurlTitle(post))
+	}
+	fs.awaitStopped()
+	select {
+	case <-fs.disconnected:
+	case <-time.After(fakeSlackTimeout):
+		t.Fatal("The bot didn't close its websocket")
+	}
+	if team.conn.connected() {
+		t.Error("Expected to be disconnected after shutting down")
+	}
+}
+
+func TestSlowJiraDoesNotHoldUpOtherChannels(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("SLOW-1", "Slow")
+	fs.addIssue("FAST-1", "Fast")
+	release := fs.holdIssue("SLOW-1")
+	fs.startBot(teamConfig{})
+
+	// C1 and C2 are handled by different workers
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#SLOW-1","ts":"1500000001.000001"}`)
+	fs.awaitJiraRequest("SLOW-1")
+	fs.send(`{"type":"message","channel":"C2","user":"U1","text":"jira#FAST-1","ts":"1500000001.000002"}`)
+	if post := fs.awaitPost(); post.Message.Channel != "C2" || unfurlTitle(post) != "FAST-1: Fast" {
+		t.Fatalf("Expected the reply in C2 first, got %+v", post)
+	}
+	release()
+	if post := fs.awaitPost(); post.Message.Channel != "C1" || unfurlTitle(post) != "SLOW-1: Slow" {
+		t.Fatalf("Expected the reply in C1 once jira answered, got %+v", post)
+	}
+}
+
+func TestRepliesInOneChannelKeepTheirOrder(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ORD-1", "First")
+	fs.addIssue("ORD-2", "Second")
+	release := fs.holdIssue("ORD-1")
+	fs.startBot(teamConfig{})
+
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ORD-1","ts":"1500000001.000001"}`)
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ORD-2","ts":"1500000001.000002"}`)
+	fs.awaitJiraRequest("ORD-1")
+	fs.expectNoPost(500 * time.Millisecond)
+	release()
+	for _, want := range []string{"ORD-1: First", "ORD-2: Second"} {
+		if post := fs.awaitPost(); unfurlTitle(post) != want {
+			t.Fatalf("Expected the reply with %s next, got [%s]", want, unfurlTitle(post))
+		}
+	}
+}
+
+func TestHungHandlerTimesOut(t *testing.T) {
+	reg := &handlerRegistration{
+		name:    "hung",
+		handler: eventHandlerFunc(func(ctx context.Context, team *slackTeam, slackEvent slackRtmEvent) { <-ctx.Done() }),
+		timeout: 50 * time.Millisecond,
+	}
+	team := newSlackTeam(teamConfig{})
+	finished := make(chan struct{})
+	go func() {
+		reg.run(team, slackRtmEvent{Type: "message"})
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Handler wasn't abandoned after its timeout")
+	}
+	// cancelled, the handler gives up too, leaving nothing running
+	if !team.finishWork(time.Now().Add(time.Second)) {
+		t.Error("Expected the cancelled handler to have returned")
+	}
+}
+
+func TestTimedOutHandlerIsCancelledWithoutReplying(t *testing.T) {
+	saved := config.HandlerTimeout
+	defer func() { config.HandlerTimeout = saved }()
+	config.HandlerTimeout = 1
+	fs := newFakeSlack(t)
+	fs.addIssue("ORD-1", "Slow")
+	fs.addIssue("ORD-2", "Fast")
+	release := fs.holdIssue("ORD-1")
+	defer release()
+	team := fs.startBot(teamConfig{})
+
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ORD-1","ts":"1500000001.000001"}`)
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ORD-2","ts":"1500000001.000002"}`)
+	if post := fs.awaitPost(); unfurlTitle(post) != "ORD-2: Fast" {
+		t.Fatalf("Expected the reply for ORD-2 once ORD-1 timed out, got [%s]", unfurlTitle(post))
+	}
+	// the jira request was cancelled, so there's nothing left to finish
+	if !team.finishWork(time.Now().Add(time.Second)) {
+		t.Error("Expected the timed out handler to have returned")
+	}
+	fs.expectNoPost(200 * time.Millisecond)
+}
+
+func TestReassemblesEventsSplitAcrossFrames(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-1", "In pieces")
+	fs.addIssue("ABC-2", "In one piece")
+	fs.startBot(teamConfig{})
+
+	fs.sendFragmented(`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-1","ts":"1500000001.000001"}`, 4)
+	if post := fs.awaitPost(); unfurlTitle(post) != "ABC-1: In pieces" {
+		t.Errorf("Unexpected reply to a fragmented event [%s]", unfurlTitle(post))
+	}
+	// and the stream is still in step afterwards
+	fs.send(`{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-2","ts":"1500000001.000002"}`)
+	if post := fs.awaitPost(); unfurlTitle(post) != "ABC-2: In one piece" {
+		t.Errorf("Unexpected reply after a fragmented event [%s]", unfurlTitle(post))
+	}
+}
+
+func TestReceivesEventsOverTheOldSizeLimit(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-1", "Whole")
+	fs.addIssue("ABC-2", "Fragmented")
+	fs.startBot(teamConfig{})
+
+	padding := strings.Repeat("lorem ipsum ", 2000)
+	big := `{"type":"message","channel":"C1","user":"U1","text":"jira#%s %s","ts":"%s"}`
+	fs.send(fmt.Sprintf(big, "ABC-1", padding, "1500000001.000001"))
+	if post := fs.awaitPost(); unfurlTitle(post) != "ABC-1: Whole" {
+		t.Errorf("Unexpected reply to a %d byte event [%s]", len(padding), unfurlTitle(post))
+	}
+	fs.sendFragmented(fmt.Sprintf(big, "ABC-2", padding, "1500000001.000002"), 3)
+	if post := fs.awaitPost(); unfurlTitle(post) != "ABC-2: Fragmented" {
+		t.Errorf("Unexpected reply to a fragmented %d byte event [%s]", len(padding), unfurlTitle(post))
+	}
+}
+
+func TestJsonScannerFindsTheEndAcrossFrames(t *testing.T) {
+	for _, tc := range []struct {
+		frames   []string
+		complete int
+	}{
+		{[]string{`{"type":"hello"}`}, 0},
+		{[]string{`{"text":"`, `}{]\"`, `"}`}, 2},
+		{[]string{`{"a":[{`, `}],"b":"\\"`, `}`}, 2},
+		{[]string{"  \n", `{}`}, 0},
+		{[]string{`not json`}, 0},
+	} {
+		var scan jsonScanner
+		done := -1
+		for i, frame := range tc.frames {
+			if scan.complete([]byte(frame)) {
+				done = i
+				break
+			}
+		}
+		if done != tc.complete {
+			t.Errorf("Expected %q to be complete after frame %d, got %d", tc.frames, tc.complete, done)
+		}
+	}
+}
+
+func TestKeepsTheLastErrorSlackSent(t *testing.T) {
+	fs := newFakeSlack(t)
+	team := fs.startBot(teamConfig{})
+	if err, _ := team.conn.getError(); err != nil {
+		t.Fatalf("Expected no error yet, got [%s]", err)
+	}
+
+	fs.send(`{"type":"error","error":{"code":2,"msg":"message text is missing"}}`)
+	for deadline := time.Now().Add(fakeSlackTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err, at := team.conn.getError(); err != nil {
+			if err.Error() != "code [2] msg [message text is missing]" || at.IsZero() {
+				t.Errorf("Unexpected error [%s] at %s", err, at)
+			}
+			return
+		}
+	}
+	t.Fatal("The error slack sent wasn't kept")
+}
+
+func TestUnacknowledgedMessagesWaitForReconnect(t *testing.T) {
+	fs := newFakeSlack(t)
+	team := fs.startBot(teamConfig{})
+
+	fs.dropConnection()
+	sent := team.poster.createSlackPost("Sent while reconnecting", "C1")
+	fs.awaitConnection()
+	if post := fs.awaitPost(); post.Message.Text != "Sent while reconnecting" {
+		t.Errorf("Unexpected post after reconnecting %+v", post)
+	}
+	if result := <-sent; result.Err != nil {
+		t.Errorf("Expected the message to be delivered, got %s", result.Err)
+	}
+}
+
+func TestRtmSendGivesUpOnlyWhenStopping(t *testing.T) {
+	team := newSlackTeam(teamConfig{Name: t.Name()})
+	session := newRtmSession(team)
+	sent := make(chan error, 1)
+	go func() {
+		_, err := session.send(slackMessage{Channel: "C1", Text: "never connected"})
+		sent <- err
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("Expected to keep waiting for a connection, got [%v]", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	team.shutdown()
+	select {
+	case err := <-sent:
+		if err == nil || !strings.Contains(err.Error(), "shutting down") {
+			t.Errorf("Expected to give up because we're stopping, got [%v]", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected to give up once the team is stopping")
+	}
+}
+
+func TestOutboundQueueStopsWithTheTeam(t *testing.T) {
+	stop := make(chan struct{})
+	q := newOutboundQueue(func(msg slackMessage) (string, error) {
+		return "1500000001.000001", nil
+	}, nil, stop)
+	q.createSlackPost("before stopping", "C1")
+	if !q.drain(time.Now().Add(fakeSlackTimeout)) {
+		t.Fatal("Expected the queue to drain")
+	}
+
+	close(stop)
+	for deadline := time.Now().Add(fakeSlackTimeout); ; time.Sleep(10 * time.Millisecond) {
+		q.mu.Lock()
+		running := q.running
+		q.mu.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the queue to stop sending once the team stopped")
+		}
+	}
+	// shutting down handlers may still have something to say
+	if result := <-q.createSlackPost("while stopping", "C1"); result.Err != nil {
+		t.Errorf("Expected a message queued after stopping to be delivered, got %s", result.Err)
+	}
+	if !q.drain(time.Now().Add(fakeSlackTimeout)) {
+		t.Error("Expected the queue to drain after stopping")
+	}
+}
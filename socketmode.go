@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Socket Mode wraps every event in an envelope which must be acknowledged by
+// echoing its envelope_id back over the socket.
+// {"envelope_id":"STRING","type":"events_api","accepts_response_payload":false,"payload":{"event":{...}}}
+type socketModeEnvelope struct {
+	EnvelopeId string          `json:"envelope_id,omitempty"`
+	Type       string          `json:"type"`
+	Reason     string          `json:"reason,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+}
+
+type socketModeAck struct {
+	EnvelopeId string `json:"envelope_id"`
+}
+
+// The events_api payload is a regular Events API callback; we only want the inner event
+type socketModeEventsApiPayload struct {
+	Event slackRtmEvent `json:"event"`
+}
+
+// appsConnectionsOpen ...
+// Asks slack for a Socket Mode websocket url using the app-level token
+func appsConnectionsOpen(team *slackTeam) (string, error) {
+	log.Printf("Attempting apps.connections.open [%s]...", team.config.SlackApiUrl)
+	var resp slackApiResp
+	appClient := newSlackWebClient(team.config.SlackApiUrl, team.config.SlackAppToken)
+	if err := appClient.call("apps.connections.open", struct{}{}, &resp); err != nil {
+		return "", err
+	}
+	logDebug(fmt.Sprintf("Offered websocket URL: [%s]", resp.Url))
+	return resp.Url, nil
+}
+
+func connAndCreateSocketModeClient(team *slackTeam) (websocketData, error) {
+	if err := team.learnBotIdentity(); err != nil {
+		return websocketData{}, err
+	}
+	if err := team.loadDirectory(); err != nil {
+		log.Printf("Error loading users and channels for team [%s]: %s", team.name(), err)
+	}
+	wssUrl, err := appsConnectionsOpen(team)
+	if err != nil {
+		return websocketData{}, err
+	}
+	return connectWebsocket(wssUrl)
+}
+
+// connectSocketMode ...
+// Closes wsClient (if connected) and blocks until a new connection is up, or
+// we've given up on it (or the team is stopping)
+func connectSocketMode(team *slackTeam, wsClient websocketData, b *connectionBackoff) (websocketData, error) {
+	if wsClient.ws != nil {
+		team.conn.set(connStateReconnecting)
+		wsClient.ws.Close()
+	}
+	if delay := b.beforeConnect(); delay > 0 {
+		log.Printf("Last connection for team [%s] didn't last; waiting %s before reconnecting", team.name(), delay)
+		if err := sleepUnlessStopped(delay, team.stop); err != nil {
+			return websocketData{}, err
+		}
+	}
+	wsClient, err := connectWithRetry(fmt.Sprintf("slack Socket Mode for team [%s]", team.name()), b.backoff, team.stop, func() (websocketData, error) {
+		return connAndCreateSocketModeClient(team)
+	})
+	if err != nil {
+		return websocketData{}, err
+	}
+	team.conn.set(connStateConnecting)
+	return wsClient, nil
+}
+
+// ackSocketModeEnvelope ...
+func (wsClient *websocketData) ackSocketModeEnvelope(envelopeId string) error {
+	jPayload, err := json.Marshal(socketModeAck{envelopeId})
+	if err != nil {
+		return fmt.Errorf("Error encoding socketModeAck payload: %s", err)
+	}
+	return wsClient.writeSocket(jPayload)
+}
+
+// connectToSlackSocketMode ...
+// Like connectToSlack, but speaking Socket Mode. Slack won't accept posts over
+// this socket, so replies go out through the Web API.
+func connectToSlackSocketMode(team *slackTeam) {
+	team.poster = newOutboundQueue(team.web.chatPostMessage, team.web, team.stop)
+	b := newConnectionBackoff()
+	wsClient, err := connectSocketMode(team, websocketData{}, b)
+	if err != nil {
+		team.stopConnecting(err)
+		return
+	}
+	done := make(chan struct{})
+	frames := wsClient.startReader(done)
+	// Socket Mode has no ping message of its own, so we send websocket pings;
+	// if not even their pongs arrive, the connection is dead
+	interval := pingInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	reconnect := func() bool {
+		close(done)
+		var err error
+		if wsClient, err = connectSocketMode(team, wsClient, b); err != nil {
+			team.stopConnecting(err)
+			return false
+		}
+		done = make(chan struct{})
+		frames = wsClient.startReader(done)
+		return true
+	}
+	for {
+		var readFromSlack []byte
+		select {
+		case <-team.stop:
+			// Our posts go over the Web API, so there's no need to keep
+			// reading; anything we haven't acknowledged slack will redeliver
+			close(done)
+			team.finishWorkLogged()
+			wsClient.ws.Close()
+			team.conn.set(connStateDisconnected)
+			log.Printf("Disconnected team [%s] from slack", team.name())
+			return
+		case frame := <-frames:
+			if frame.err != nil {
+				log.Printf("Error reading from slack [%s]. Attempting reconnection...", frame.err)
+				team.conn.setError(frame.err)
+				if !reconnect() {
+					return
+				}
+				continue
+			}
+			readFromSlack = frame.data
+		case <-ticker.C:
+			if quiet := wsClient.activity.since(); quiet > interval*rtmMissedPongsAllowed {
+				log.Printf("Nothing from slack for %s! Attempting reconnection...", quiet.Round(time.Millisecond))
+				team.conn.setError(fmt.Errorf("nothing from slack for %s", quiet.Round(time.Millisecond)))
+				if !reconnect() {
+					return
+				}
+				continue
+			}
+			// If the socket is broken, the reader will notice and reconnect
+			if err := wsClient.sendPing(); err != nil {
+				log.Printf("Failed pinging slack: %s", err)
+			}
+			continue
+		}
+		logDebug(fmt.Sprintf("received: %s", readFromSlack))
+
+		var envelope socketModeEnvelope
+		if err := json.Unmarshal(readFromSlack, &envelope); err != nil {
+			log.Printf("Invalid json received from slack? [%s]", err)
+			continue
+		}
+		if len(envelope.EnvelopeId) > 0 {
+			if err := wsClient.ackSocketModeEnvelope(envelope.EnvelopeId); err != nil {
+				log.Printf("Failed acknowledging envelope [%s]: %s", envelope.EnvelopeId, err)
+			}
+		}
+		switch envelope.Type {
+		case "hello":
+			log.Printf("Socket Mode connection established for team [%s]", team.name())
+			b.established()
+			team.conn.set(connStateConnected)
+		case "disconnect":
+			log.Printf("Slack requested disconnect [%s]. Reconnecting...", envelope.Reason)
+			team.conn.setError(fmt.Errorf("slack requested disconnect [%s]", envelope.Reason))
+			if !reconnect() {
+				return
+			}
+		case "events_api":
+			var payload socketModeEventsApiPayload
+			if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+				log.Printf("Invalid events_api payload received from slack? [%s]", err)
+				continue
+			}
+			handleSlackEvent(team, payload.Event)
+		default:
+			logDebug(fmt.Sprintf("Ignoring Socket Mode envelope type [%s]", envelope.Type))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSocketModeAcksAndDispatchesEvents(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-1", "Over Socket Mode")
+	team := fs.startSocketModeBot(teamConfig{})
+
+	fs.send(`{"envelope_id":"env-1","type":"events_api","accepts_response_payload":false,"payload":` +
+		`{"team_id":"T1","event":{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-1","ts":"1500000001.000001"}}}`)
+	if id := fs.awaitAck(); id != "env-1" {
+		t.Errorf("Expected env-1 to be acknowledged, got [%s]", id)
+	}
+	post := fs.awaitPost()
+	if post.Method != "chat.postMessage" || unfurlTitle(post) != "ABC-1: Over Socket Mode" {
+		t.Errorf("Unexpected reply [%s] via [%s]", unfurlTitle(post), post.Method)
+	}
+	if !team.conn.connected() {
+		t.Error("Expected to be connected")
+	}
+}
+
+func TestSocketModeIgnoresOwnMessages(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-1", "Talking to myself")
+	fs.startSocketModeBot(teamConfig{})
+
+	fs.send(`{"envelope_id":"env-1","type":"events_api","payload":` +
+		`{"event":{"type":"message","channel":"C1","user":"UBOT","text":"jira#ABC-1","ts":"1500000001.000001"}}}`)
+	fs.awaitAck()
+	fs.expectNoPost(200 * time.Millisecond)
+}
+
+func TestSocketModeReconnectsWhenPongsStop(t *testing.T) {
+	fs := newFakeSlack(t)
+	team := fs.startSocketModeBot(teamConfig{})
+
+	fs.mu.Lock()
+	fs.ignorePings = true
+	fs.mu.Unlock()
+	// the ack is the last thing slack reads from this connection
+	fs.send(`{"envelope_id":"env-1","type":"events_api","payload":{"event":{"type":"user_typing","channel":"C1","user":"U1"}}}`)
+	fs.awaitAck()
+	fs.awaitConnection()
+	fs.mu.Lock()
+	opened := fs.connectionsOpened
+	fs.ignorePings = false
+	fs.mu.Unlock()
+	if opened != 2 {
+		t.Errorf("Expected 2 calls to apps.connections.open, got %d", opened)
+	}
+	if err, _ := team.conn.getError(); err == nil || !strings.Contains(err.Error(), "nothing from slack") {
+		t.Errorf("Expected the dead connection to be kept as the last error, got [%v]", err)
+	}
+}
+
+func TestSocketModeReconnectsOnDisconnect(t *testing.T) {
+	fs := newFakeSlack(t)
+	fs.addIssue("ABC-2", "After reconnecting")
+	team := fs.startSocketModeBot(teamConfig{})
+
+	fs.send(`{"type":"disconnect","reason":"refresh_requested","debug_info":{"host":"applink-1"}}`)
+	fs.awaitConnection()
+	if err, _ := team.conn.getError(); err == nil || !strings.Contains(err.Error(), "refresh_requested") {
+		t.Errorf("Expected the disconnect to be kept as the last error, got [%v]", err)
+	}
+	fs.mu.Lock()
+	opened := fs.connectionsOpened
+	fs.mu.Unlock()
+	if opened != 2 {
+		t.Errorf("Expected 2 calls to apps.connections.open, got %d", opened)
+	}
+
+	fs.send(`{"envelope_id":"env-2","type":"events_api","payload":` +
+		`{"event":{"type":"message","channel":"C1","user":"U1","text":"jira#ABC-2","ts":"1500000001.000002"}}}`)
+	if id := fs.awaitAck(); id != "env-2" {
+		t.Errorf("Expected env-2 to be acknowledged, got [%s]", id)
+	}
+	if post := fs.awaitPost(); unfurlTitle(post) != "ABC-2: After reconnecting" {
+		t.Errorf("Unexpected reply after reconnecting [%s]", unfurlTitle(post))
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// slackTeam is one workspace we're connected to, and everything we know
+// about it. Each team reconnects independently of the others.
+type slackTeam struct {
+	config teamConfig
+	web    *slackWebClient
+	// where handlers post; set up by the team's transport
+	poster  slackPoster
+	conn    *connStatus
+	self    *botIdentity
+	replies *replyTracker
+	// Events API callbacks already handled, to spot slack's retries
+	recentEvents *recentEventIds
+	// users and channels, so config and handlers can use names
+	directory *slackDirectory
+	store     struct {
+		// held while looking for today's dilbert
+		sync.Mutex
+		DilbertBackOffUntil time.Time
+	}
+	// closed by shutdown
+	stop     chan struct{}
+	stopOnce sync.Once
+	// events still being handled, and who's handling them
+	work    sync.WaitGroup
+	workers *workerPool
+}
+
+func newSlackTeam(teamConf teamConfig) *slackTeam {
+	return &slackTeam{
+		config:       teamConf,
+		web:          newSlackWebClient(teamConf.SlackApiUrl, teamConf.SlackApiToken),
+		conn:         &connStatus{team: teamConf.Name},
+		self:         &botIdentity{},
+		replies:      newReplyTracker(),
+		recentEvents: newRecentEventIds(),
+		directory:    newSlackDirectory(),
+		stop:         make(chan struct{}),
+		workers:      newEventWorkerPool(),
+	}
+}
+
+// name ...
+// How the team shows up in logs
+func (team *slackTeam) name() string {
+	if len(team.config.Name) == 0 {
+		return "default"
+	}
+	return team.config.Name
+}
+
+// channelSettings ...
+// Returns the settings for channel, keyed by its ID or "#name", falling back to
+// the "default" entry
+func (team *slackTeam) channelSettings(channel string) channelConfig {
+	if settings, ok := team.config.Channels[channel]; ok {
+		return settings
+	}
+	if known, ok := team.directory.channel(channel); ok {
+		if settings, ok := team.config.Channels["#"+known.Name]; ok {
+			return settings
+		}
+	}
+	return team.config.Channels["default"]
+}
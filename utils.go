@@ -21,22 +21,59 @@ func populateConfig() {
 	if jsonErr != nil {
 		log.Fatal(fmt.Sprintf("Failed decoding configFile [%s]: %s", configFile, jsonErr))
 	}
-	// Ensure required config items are set
+	teamNames := map[string]bool{}
+	for _, team := range config.teamConfigs() {
+		if len(config.Teams) > 0 && len(team.Name) == 0 {
+			log.Fatal("Every entry in Teams needs a Name")
+		}
+		if teamNames[team.Name] {
+			log.Fatal(fmt.Sprintf("Team [%s] configured twice", team.Name))
+		}
+		teamNames[team.Name] = true
+		validateTeamConfig(team)
+	}
+}
+
+// validateTeamConfig ...
+// Ensure required config items are set
+func validateTeamConfig(team teamConfig) {
 	reqConfigItems := []string{
-		config.SlackApiUrl,
-		config.SlackApiToken,
-		config.SlackDilbertChannel,
-		config.JiraUrl,
-		config.JiraUser,
-		config.JiraPass}
+		team.SlackApiUrl,
+		team.SlackApiToken,
+		team.SlackDilbertChannel,
+		team.JiraUrl,
+		team.JiraUser,
+		team.JiraPass}
+	switch team.SlackTransport {
+	case "", transportRtm:
+	case transportSocketMode:
+		reqConfigItems = append(reqConfigItems, team.SlackAppToken)
+	case transportEvents:
+		reqConfigItems = append(reqConfigItems, team.SlackSigningSecret, config.EventsListenAddr)
+	default:
+		log.Fatal(fmt.Sprintf("Unknown SlackTransport [%s] for team [%s]", team.SlackTransport, team.Name))
+	}
 	for _, item := range reqConfigItems {
 		if len(item) < 1 {
-			log.Fatal("Missing required config item(s)")
+			log.Fatal(fmt.Sprintf("Missing required config item(s) for team [%s]", team.Name))
+		}
+	}
+	for channel, settings := range team.Channels {
+		switch settings.ThreadReplies {
+		case "", threadRepliesFollow, threadRepliesAlways, threadRepliesNever:
+		default:
+			log.Fatal(fmt.Sprintf("Unknown ThreadReplies [%s] for channel [%s]", settings.ThreadReplies, channel))
 		}
 	}
 }
 
+// homeEtcDir, when set, is used in place of ~/etc
+var homeEtcDir string
+
 func getHomeEtc() string {
+	if len(homeEtcDir) > 0 {
+		return homeEtcDir
+	}
 	usr, err := user.Current()
 	if err != nil {
 		log.Fatal(fmt.Sprintf("Failed getting users home directory: %s", err))
@@ -55,7 +92,7 @@ func logDebug(msg string) {
 	if len(os.Getenv("databot_debug")) == 0 {
 		return
 	}
-	log.Printf(fmt.Sprintf("DEBUG: %s", msg))
+	log.Printf("DEBUG: %s", msg)
 }
 
 func createDirIfMissing(fileLoc string, perm uint32) error {
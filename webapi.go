@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// RTM refuses messages longer than this; anything bigger goes over the Web API
+	rtmMaxTextLength = 4000
+	// How many times we'll sit out a 429 before giving up on a call
+	slackApiRateLimitRetries = 3
+	// Used when a 429 comes back without a usable Retry-After
+	slackApiDefaultRetryAfter = 30 * time.Second
+)
+
+// Every Web API response carries at least these fields
+type slackApiResp struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Url   string `json:"url,omitempty"`
+}
+
+// slackMessage is everything chat.postMessage / chat.update can say
+type slackMessage struct {
+	Channel        string            `json:"channel"`
+	Text           string            `json:"text,omitempty"`
+	Ts             string            `json:"ts,omitempty"`
+	ThreadTs       string            `json:"thread_ts,omitempty"`
+	ReplyBroadcast bool              `json:"reply_broadcast,omitempty"`
+	Attachments    []slackAttachment `json:"attachments,omitempty"`
+	Blocks         json.RawMessage   `json:"blocks,omitempty"`
+	UnfurlLinks    bool              `json:"unfurl_links,omitempty"`
+}
+
+type slackAttachment struct {
+	Fallback   string                 `json:"fallback,omitempty"`
+	Color      string                 `json:"color,omitempty"`
+	Pretext    string                 `json:"pretext,omitempty"`
+	Title      string                 `json:"title,omitempty"`
+	TitleLink  string                 `json:"title_link,omitempty"`
+	Text       string                 `json:"text,omitempty"`
+	Fields     []slackAttachmentField `json:"fields,omitempty"`
+	Footer     string                 `json:"footer,omitempty"`
+	Ts         int64                  `json:"ts,omitempty"`
+	MrkdwnIn   []string               `json:"mrkdwn_in,omitempty"`
+	AuthorName string                 `json:"author_name,omitempty"`
+}
+
+type slackAttachmentField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short,omitempty"`
+}
+
+// What chat.postMessage and chat.update tell us about the message they touched
+type slackChatResp struct {
+	slackApiResp
+	Channel string `json:"channel"`
+	Ts      string `json:"ts"`
+}
+
+type slackAuthTestResp struct {
+	slackApiResp
+	Team   string `json:"team"`
+	User   string `json:"user"`
+	TeamId string `json:"team_id"`
+	UserId string `json:"user_id"`
+	BotId  string `json:"bot_id,omitempty"`
+}
+
+// slackWebClient calls Slack Web API methods over the shared httpClient
+type slackWebClient struct {
+	http   httpClient
+	apiUrl string
+	token  string
+}
+
+// newSlackWebClient ...
+// Returns a client for apiUrl authenticating with token
+func newSlackWebClient(apiUrl string, token string) *slackWebClient {
+	return &slackWebClient{
+		http:   client,
+		apiUrl: apiUrl,
+		token:  token,
+	}
+}
+
+// call ...
+// POSTs payload as JSON to the given Web API method and decodes the response
+// into result (which may be nil). Rate limited calls are retried after
+// sleeping for as long as slack's Retry-After asks.
+func (c *slackWebClient) call(method string, payload interface{}, result interface{}) error {
+	jPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Error encoding %s payload: %s", method, err)
+	}
+	return c.post(method, "application/json;charset=UTF-8", jPayload, result)
+}
+
+// callForm ...
+// call for the (mostly read-only) methods which don't accept JSON bodies
+func (c *slackWebClient) callForm(method string, args url.Values, result interface{}) error {
+	return c.post(method, "application/x-www-form-urlencoded", []byte(args.Encode()), result)
+}
+
+// post ...
+func (c *slackWebClient) post(method string, contentType string, body []byte, result interface{}) error {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", c.apiUrl, method), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+		resp, err := c.http.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("Error in /%s POST request to [%s]: %s", method, c.apiUrl, err)
+		}
+		bsRb, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < slackApiRateLimitRetries {
+			retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+			log.Printf("Rate limited calling %s; retrying in %s", method, retryAfter)
+			time.Sleep(retryAfter)
+			continue
+		}
+		if resp.StatusCode != 200 {
+			return fmt.Errorf("Got http code [%d] back from [%s/%s]", resp.StatusCode, c.apiUrl, method)
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading response body: %s", err)
+		}
+		var apiResp slackApiResp
+		if err := json.Unmarshal(bsRb, &apiResp); err != nil {
+			return fmt.Errorf("Error JSON decoding response body: %s", err)
+		}
+		if !apiResp.Ok {
+			return fmt.Errorf("%s failed: %s", method, apiResp.Error)
+		}
+		if result != nil {
+			if err := json.Unmarshal(bsRb, result); err != nil {
+				return fmt.Errorf("Error JSON decoding response body: %s", err)
+			}
+		}
+		return nil
+	}
+}
+
+// parseRetryAfter ...
+func parseRetryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(header)
+	if err != nil || seconds < 0 {
+		return slackApiDefaultRetryAfter
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// postMessage ...
+// chat.postMessage; returns the channel and ts slack assigned the message
+func (c *slackWebClient) postMessage(msg slackMessage) (slackChatResp, error) {
+	msg.Ts = ""
+	var resp slackChatResp
+	err := c.call("chat.postMessage", msg, &resp)
+	return resp, err
+}
+
+// slackUpdateMessage is a slackMessage for chat.update, which keeps whatever
+// text and attachments it isn't sent; they're always sent, even when empty
+type slackUpdateMessage struct {
+	slackMessage
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+// updateMessage ...
+// chat.update; msg.Channel and msg.Ts identify the message to replace
+func (c *slackWebClient) updateMessage(msg slackMessage) (slackChatResp, error) {
+	update := slackUpdateMessage{slackMessage: msg, Text: msg.Text, Attachments: msg.Attachments}
+	if update.Attachments == nil {
+		update.Attachments = []slackAttachment{}
+	}
+	var resp slackChatResp
+	err := c.call("chat.update", update, &resp)
+	return resp, err
+}
+
+// deleteMessage ...
+func (c *slackWebClient) deleteMessage(channel string, ts string) error {
+	payload := map[string]string{"channel": channel, "ts": ts}
+	return c.call("chat.delete", payload, nil)
+}
+
+type slackPermalinkResp struct {
+	slackApiResp
+	Permalink string `json:"permalink"`
+}
+
+// getPermalink ...
+// chat.getPermalink; a link to the message at ts in channel
+func (c *slackWebClient) getPermalink(channel string, ts string) (string, error) {
+	var resp slackPermalinkResp
+	err := c.callForm("chat.getPermalink", url.Values{"channel": {channel}, "message_ts": {ts}}, &resp)
+	return resp.Permalink, err
+}
+
+// authTest ...
+// Tells us who our token belongs to
+func (c *slackWebClient) authTest() (slackAuthTestResp, error) {
+	var resp slackAuthTestResp
+	err := c.call("auth.test", struct{}{}, &resp)
+	return resp, err
+}
+
+// chatPostMessage ...
+// postMessage for transports which (unlike RTM) cannot send messages over the
+// socket they receive events on, and so don't care about the response.
+func (c *slackWebClient) chatPostMessage(msg slackMessage) (string, error) {
+	resp, err := c.postMessage(msg)
+	return resp.Ts, err
+}
+
+// Paged list methods say where the next page starts here
+type slackResponseMetadata struct {
+	NextCursor string `json:"next_cursor"`
+}
+
+type slackUsersListResp struct {
+	slackApiResp
+	Members          []slackUser           `json:"members"`
+	ResponseMetadata slackResponseMetadata `json:"response_metadata"`
+}
+
+type slackConversationsListResp struct {
+	slackApiResp
+	Channels         []slackChannel        `json:"channels"`
+	ResponseMetadata slackResponseMetadata `json:"response_metadata"`
+}
+
+// listUsers ...
+// users.list, every page of it
+func (c *slackWebClient) listUsers() ([]slackUser, error) {
+	var users []slackUser
+	cursor := ""
+	for {
+		var resp slackUsersListResp
+		args := url.Values{"limit": {"200"}, "cursor": {cursor}}
+		if err := c.callForm("users.list", args, &resp); err != nil {
+			return nil, err
+		}
+		users = append(users, resp.Members...)
+		if cursor = resp.ResponseMetadata.NextCursor; len(cursor) == 0 {
+			return users, nil
+		}
+	}
+}
+
+// listConversations ...
+// conversations.list of every channel we can see, every page of it
+func (c *slackWebClient) listConversations() ([]slackChannel, error) {
+	var channels []slackChannel
+	cursor := ""
+	for {
+		var resp slackConversationsListResp
+		args := url.Values{
+			"limit":            {"200"},
+			"cursor":           {cursor},
+			"types":            {"public_channel,private_channel"},
+			"exclude_archived": {"true"},
+		}
+		if err := c.callForm("conversations.list", args, &resp); err != nil {
+			return nil, err
+		}
+		channels = append(channels, resp.Channels...)
+		if cursor = resp.ResponseMetadata.NextCursor; len(cursor) == 0 {
+			return channels, nil
+		}
+	}
+}
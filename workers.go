@@ -0,0 +1,67 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"sync/atomic"
+)
+
+const (
+	defaultEventWorkers   = 4
+	defaultEventQueueSize = 100
+)
+
+// workerPool runs jobs on a fixed number of goroutines. Jobs submitted under
+// the same key always go to the same worker, so they run one at a time and in
+// the order they were submitted.
+type workerPool struct {
+	queues  []chan func()
+	dropped int64
+}
+
+func newWorkerPool(workers int, queueSize int) *workerPool {
+	pool := &workerPool{}
+	for i := 0; i < workers; i++ {
+		queue := make(chan func(), queueSize)
+		pool.queues = append(pool.queues, queue)
+		go pool.work(queue)
+	}
+	return pool
+}
+
+// newEventWorkerPool ...
+// A pool sized by config.EventWorkers and config.EventQueueSize
+func newEventWorkerPool() *workerPool {
+	workers := defaultEventWorkers
+	if config.EventWorkers > 0 {
+		workers = config.EventWorkers
+	}
+	queueSize := defaultEventQueueSize
+	if config.EventQueueSize > 0 {
+		queueSize = config.EventQueueSize
+	}
+	return newWorkerPool(workers, queueSize)
+}
+
+// submit ...
+// Queues job behind everything else submitted under key. False if that
+// worker's queue is full and job was dropped.
+func (pool *workerPool) submit(key string, job func()) bool {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	select {
+	case pool.queues[hash.Sum32()%uint32(len(pool.queues))] <- job:
+		return true
+	default:
+		dropped := atomic.AddInt64(&pool.dropped, 1)
+		log.Printf("Worker queue for [%s] is full; %d jobs dropped so far", key, dropped)
+		return false
+	}
+}
+
+// work ...
+func (pool *workerPool) work(queue chan func()) {
+	for job := range queue {
+		job()
+	}
+}
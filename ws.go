@@ -1,43 +1,205 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"golang.org/x/net/websocket"
-	"log"
-	//"time"
+	"net"
+	"sync/atomic"
+	"time"
 )
 
+// Guards against a peer which never finishes a fragmented message
+const wsMaxMessageBytes = 16 * 1024 * 1024
+
 type websocketData struct {
 	ws *websocket.Conn
+	// what's been read off the connection underneath ws
+	activity *wsActivity
+}
+
+// wsActivity notes when anything was last read off a connection, including
+// the ping and pong frames the websocket package answers and swallows
+type wsActivity struct {
+	net.Conn
+	lastRead int64
+}
+
+// Read ...
+func (c *wsActivity) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// since ...
+// How long it's been since anything arrived
+func (c *wsActivity) since() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
 }
 
 // connectWebsocket ...
-func connectWebsocket(wssUrl string) *websocket.Conn {
-	ws, err := websocket.Dial(wssUrl, "", "http://localhost/")
+// Dials the connection ourselves, rather than leaving it to websocket.Dial, so
+// we can tell when it's gone quiet
+func connectWebsocket(wssUrl string) (websocketData, error) {
+	wsConfig, err := websocket.NewConfig(wssUrl, "http://localhost/")
+	if err != nil {
+		return websocketData{}, fmt.Errorf("Error connecting to websocket: %s", err)
+	}
+	host := wsConfig.Location.Host
+	var conn net.Conn
+	switch wsConfig.Location.Scheme {
+	case "ws":
+		if len(wsConfig.Location.Port()) == 0 {
+			host = net.JoinHostPort(host, "80")
+		}
+		conn, err = net.Dial("tcp", host)
+	case "wss":
+		if len(wsConfig.Location.Port()) == 0 {
+			host = net.JoinHostPort(host, "443")
+		}
+		conn, err = tls.Dial("tcp", host, nil)
+	default:
+		err = fmt.Errorf("unsupported scheme [%s]", wsConfig.Location.Scheme)
+	}
+	if err != nil {
+		return websocketData{}, fmt.Errorf("Error connecting to websocket: %s", err)
+	}
+	activity := &wsActivity{Conn: conn, lastRead: time.Now().UnixNano()}
+	ws, err := websocket.NewClient(wsConfig, activity)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Error connecting to websocket: %s", err))
+		conn.Close()
+		return websocketData{}, fmt.Errorf("Error connecting to websocket: %s", err)
 	}
-	//store.LastRtmConnectEpoch = time.Now().Unix()
+	return websocketData{ws: ws, activity: activity}, nil
+}
+
+// wsPing is a websocket ping frame; the websocket package answers them itself
+var wsPing = websocket.Codec{Marshal: func(v interface{}) ([]byte, byte, error) {
+	return nil, websocket.PingFrame, nil
+}}
+
+// sendPing ...
+// A websocket level ping, for when there's no application level one
+func (wsClient *websocketData) sendPing() error {
+	return wsPing.Send(wsClient.ws, nil)
+}
+
+// A single read off the websocket; err is set once the connection is unusable
+type wsFrame struct {
+	data []byte
+	err  error
+}
 
-	return ws
+// startReader ...
+// Spawns the one goroutine which reads from this connection for its whole
+// lifetime. It stops after the first read error, or once done is closed.
+func (wsClient *websocketData) startReader(done <-chan struct{}) <-chan wsFrame {
+	frames := make(chan wsFrame)
+	// Pin the connection; the caller may swap *wsClient out on reconnect
+	conn := *wsClient
+	go func() {
+		for {
+			msg, err := conn.readSocket()
+			select {
+			case frames <- wsFrame{msg, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return frames
 }
 
 // readSocket ...
-func (wsClient *websocketData) readSocket() []byte {
-	msg := make([]byte, slackMsgSizeCapBytes)
-	n, err := wsClient.ws.Read(msg)
-	if err != nil {
-		log.Fatal(err)
+// Reads one whole slack message, however large. The websocket package hands
+// us a single frame at a time without exposing the FIN bit, so a message is
+// considered complete once the JSON it holds is; everything slack sends us is
+// a JSON object. Each frame is scanned once, so large messages cost no more
+// than their size.
+func (wsClient *websocketData) readSocket() ([]byte, error) {
+	var msg []byte
+	var scan jsonScanner
+	for {
+		var frame []byte
+		if err := websocket.Message.Receive(wsClient.ws, &frame); err != nil {
+			return nil, err
+		}
+		msg = append(msg, frame...)
+		if len(msg) > wsMaxMessageBytes {
+			return nil, fmt.Errorf("websocket message exceeded %d bytes", wsMaxMessageBytes)
+		}
+		if scan.complete(frame) {
+			break
+		}
+		logDebug(fmt.Sprintf("Received %d bytes of a fragmented message, waiting for the rest", len(frame)))
+	}
+	logDebug(fmt.Sprintf("Received %d bytes", len(msg)))
+	return msg, nil
+}
+
+// jsonScanner follows the nesting of a JSON value fed to it a piece at a
+// time, just closely enough to tell when the value has ended
+type jsonScanner struct {
+	started  bool
+	depth    int
+	inString bool
+	escaped  bool
+}
+
+// complete ...
+// Feeds the next piece of the value; true once it has ended. Anything which
+// isn't an object or array, or is malformed, counts as complete so the
+// caller's decoder gets to complain about it.
+func (s *jsonScanner) complete(data []byte) bool {
+	for _, c := range data {
+		if !s.started {
+			switch c {
+			case ' ', '\t', '\r', '\n':
+				continue
+			case '{', '[':
+				s.started = true
+				s.depth = 1
+				continue
+			}
+			return true
+		}
+		switch {
+		case s.escaped:
+			s.escaped = false
+		case s.inString:
+			switch c {
+			case '\\':
+				s.escaped = true
+			case '"':
+				s.inString = false
+			}
+		case c == '"':
+			s.inString = true
+		case c == '{' || c == '[':
+			s.depth++
+		case c == '}' || c == ']':
+			s.depth--
+			if s.depth == 0 {
+				return true
+			}
+		}
 	}
-	logDebug(fmt.Sprintf("Received %d bytes", n))
-	return msg
+	// nothing but whitespace isn't worth waiting on
+	return !s.started
 }
 
 // writeSocket ...
-func (wsClient *websocketData) writeSocket(data []byte) {
+func (wsClient *websocketData) writeSocket(data []byte) error {
 	n, err := wsClient.ws.Write(data)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	logDebug(fmt.Sprintf("Wrote %d bytes", n))
+	return nil
 }